@@ -1,10 +1,13 @@
 package main
 
 import (
+	"command-on-demand/internal/audit"
 	"command-on-demand/internal/logger"
 	s "command-on-demand/internal/server"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -12,40 +15,165 @@ import (
 
 const (
 	pruneInterval = 10 * time.Second
-	writeTimeout  = 15 * time.Second
-	readTimeout   = 15 * time.Second
-	idleTimeout   = 60 * time.Second
+	// writeTimeout leaves time to write the response after waiting on Jamf for up to JamfDeadline
+	writeTimeout = s.JamfDeadline + 3*time.Second
+	readTimeout  = 15 * time.Second
+	idleTimeout  = 60 * time.Second
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(auditCommand(os.Args[2:]))
+	}
+
 	logger.Setup()
 	r := mux.NewRouter()
-	srv := s.NewServer()
-	go srv.CodeStore.Prune(pruneInterval)
-	r.HandleFunc("/api/v1/code/{udid}", srv.CodeHandler).Methods("GET")
-	r.HandleFunc("/api/v1/erase/{udid}", srv.EraseHandler).Methods("POST")
-	r.HandleFunc("/api/v1/swupd/{udid}", srv.SoftwareUpdateHandler).Methods("POST")
+	tenants := s.NewTenants()
+	for _, srv := range tenants.Servers() {
+		go srv.CodeStore.Prune(pruneInterval)
+		go srv.JobStore.Prune(pruneInterval)
+		go srv.StateStore.Prune(pruneInterval)
+		go srv.TrackCommands()
+		go srv.RefreshJamfToken()
+		go srv.Notifier.Run()
+	}
+	go tenants.WatchConfig()
+	r.Use(s.MiddlewareSetRequestId)
+	r.Use(s.MiddlewareLogging)
+
+	// admin endpoints are served on their own port when one is configured
+	adminPort := tenants.Servers()[0].AdminListenPort()
+	ar := r
+	if adminPort != "" {
+		ar = mux.NewRouter()
+		ar.Use(s.MiddlewareSetRequestId)
+		ar.Use(s.MiddlewareLogging)
+		ar.NotFoundHandler = notFound()
+	}
+
+	if tenants.Multi() {
+		// each tenant is served under its own path prefix, and client API requests without a prefix
+		// are routed to the tenant whose client token they carry
+		byToken := make(map[string]http.Handler)
+		for _, srv := range tenants.Servers() {
+			adminRoutes(ar.PathPrefix("/api/v1/t/"+srv.Tenant()+"/admin").Subrouter(), srv)
+			routes(r.PathPrefix("/api/v1/t/"+srv.Tenant()).Subrouter(), srv)
+
+			tr := mux.NewRouter()
+			tr.NotFoundHandler = notFound()
+			apiRoutes(tr.PathPrefix("/api/v1").Subrouter(), srv)
+			byToken[srv.Tenant()] = tr
+		}
+		r.PathPrefix("/api/v1/").Handler(tenants.DispatchByToken(byToken))
+	} else {
+		adminRoutes(ar.PathPrefix("/api/v1/admin").Subrouter(), tenants.Servers()[0])
+		routes(r.PathPrefix("/api/v1").Subrouter(), tenants.Servers()[0])
+	}
 
 	// skip middleware and obfuscate 404 with 403 for unknown paths
-	nfh := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusForbidden)
-		return
-	})
-	r.NotFoundHandler = nfh
+	r.NotFoundHandler = notFound()
 
-	r.Use(s.MiddlewareSetRequestId)
-	r.Use(s.MiddlewareLogging)
-	r.Use(srv.MiddlewareBearerAuth)
+	if adminPort != "" {
+		adminAddr := fmt.Sprintf("%s:%s", tenants.Servers()[0].ListenInterface(), adminPort)
+		go func() {
+			logger.Info("admin endpoints listening on ", adminAddr)
+			logger.Fatal(newHTTPServer(ar, adminAddr).ListenAndServe())
+		}()
+	}
+
+	addr := fmt.Sprintf("%s:%s", tenants.Servers()[0].ListenInterface(), tenants.Servers()[0].ListenPort())
+	logger.Info("service running and listening on ", addr)
+	logger.Fatal(newHTTPServer(r, addr).ListenAndServe())
+}
+
+// auditCommand runs the audit subcommand, where "audit verify [--tenant <name>] <file>" checks the hash chain of an
+// audit log offline, with the key the named tenant's log is written with, see s.AuditKey. It returns the process exit code
+func auditCommand(args []string) int {
+	usage := "usage: command-on-demand audit verify [--tenant <name>] <file>"
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	tenant := fs.String("tenant", "", "the tenant whose audit log is verified, when tenants are configured")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	key, err := s.AuditKey(*tenant)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
 
-	addr := fmt.Sprintf("%s:%s", srv.ListenInterface(), srv.ListenPort())
-	hs := &http.Server{
-		Handler:      r,
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	n, last, err := audit.Verify(f, key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit log verification failed after %d valid entries: %s\n", n, err)
+		return 1
+	}
+
+	fmt.Printf("audit log verified: %d entries, last hash %s\n", n, last)
+
+	return 0
+}
+
+// newHTTPServer returns an http.Server for the handler at the given address
+func newHTTPServer(h http.Handler, addr string) *http.Server {
+	return &http.Server{
+		Handler:      h,
 		Addr:         addr,
 		WriteTimeout: writeTimeout,
 		ReadTimeout:  readTimeout,
 		IdleTimeout:  idleTimeout,
 	}
+}
 
-	logger.Info("service running and listening on ", addr)
-	logger.Fatal(hs.ListenAndServe())
+// adminRoutes registers the admin routes of the given Server under the admin router, authenticated with the admin token
+func adminRoutes(admin *mux.Router, srv s.Server) {
+	admin.Use(srv.MiddlewareAdminAuth)
+	admin.HandleFunc("/pin/{id}", srv.PinLookupHandler).Methods("GET")
+	admin.HandleFunc("/budget", srv.BudgetHandler).Methods("GET")
+	admin.HandleFunc("/budget/reset", srv.BudgetResetHandler).Methods("POST")
+	admin.HandleFunc("/codes", srv.CodesHandler).Methods("GET")
+	admin.HandleFunc("/codes/flush", srv.CodesFlushHandler).Methods("POST")
+	admin.HandleFunc("/codes/{udid}", srv.CodeLookupHandler).Methods("GET")
+	admin.HandleFunc("/codes/{udid}", srv.CodeRevokeHandler).Methods("DELETE")
+}
+
+// routes registers the webhook and client API routes of the given Server under the base router
+func routes(base *mux.Router, srv s.Server) {
+	hook := base.PathPrefix("/webhook").Subrouter()
+	hook.Use(srv.MiddlewareWebhookAuth)
+	hook.HandleFunc("/jamf", srv.JamfWebhookHandler).Methods("POST")
+
+	apiRoutes(base.NewRoute().Subrouter(), srv)
+}
+
+// apiRoutes registers the client API routes of the given Server, authenticated with client tokens
+func apiRoutes(api *mux.Router, srv s.Server) {
+	api.Use(srv.MiddlewareBearerAuth)
+	api.HandleFunc("/code/{udid}", srv.CodeHandler).Methods("GET")
+	api.HandleFunc("/erase/{udid}", srv.EraseHandler).Methods("POST")
+	api.HandleFunc("/swupd/{udid}", srv.SoftwareUpdateHandler).Methods("POST")
+	api.HandleFunc("/lock/{udid}", srv.DeviceLockHandler).Methods("POST")
+	api.HandleFunc("/restart/{udid}", srv.RestartDeviceHandler).Methods("POST")
+	api.HandleFunc("/shutdown/{udid}", srv.ShutDownDeviceHandler).Methods("POST")
+	api.HandleFunc("/jobs/{id}", srv.JobHandler).Methods("GET")
+}
+
+// notFound returns a handler which obfuscates 404 with 403
+func notFound() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	})
 }
@@ -0,0 +1,268 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Events recorded in the audit log
+const (
+	// EventValidation records the outcome of validating a command request: the UDID, lockout and code proof checks
+	EventValidation = "validation"
+	// EventCommand records the outcome of building and sending a command to Jamf
+	EventCommand = "command"
+)
+
+// Outcomes of audited events
+const (
+	OutcomeAccepted = "accepted"
+	OutcomeRejected = "rejected"
+	OutcomeSent     = "sent"
+	OutcomeFailed   = "failed"
+)
+
+const (
+	// maxLineBytes is the longest audit log line which can be read
+	maxLineBytes = 1024 * 1024
+	// MinKeyBytes is the shortest HMAC key accepted by Open and Verify
+	MinKeyBytes = 32
+)
+
+// Entry is a single record in the audit log.
+// Each entry holds the hash of the previous entry, and its own hash is an HMAC-SHA256 of every other field,
+// so editing or removing an entry breaks the chain from that point on, and the chain cannot be rebuilt
+// without the key, which is held outside the log
+type Entry struct {
+	Seq        uint64            `json:"seq"`
+	Time       string            `json:"time"`
+	Tenant     string            `json:"tenant,omitempty"`
+	RequestId  string            `json:"requestId,omitempty"`
+	Token      string            `json:"token,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Event      string            `json:"event"`
+	Command    string            `json:"command"`
+	Udid       string            `json:"udid"`
+	Serial     string            `json:"serial,omitempty"`
+	ComputerId int               `json:"computerId,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+	PrevHash   string            `json:"prevHash"`
+	Hash       string            `json:"hash,omitempty"`
+}
+
+// hash returns the hex encoded HMAC-SHA256, with the given key, of the entry's JSON encoding without its own hash
+func (e Entry) hash(key []byte) (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// checkKey returns an error if the HMAC key is too short
+func checkKey(key []byte) error {
+	if len(key) < MinKeyBytes {
+		return fmt.Errorf("audit log key must be at least %d bytes", MinKeyBytes)
+	}
+
+	return nil
+}
+
+// Log is an append-only, hash-chained audit log file with one JSON Entry per line
+type Log struct {
+	sync.Mutex
+	f    *os.File
+	path string
+	key  []byte
+	seq  uint64
+	prev string
+}
+
+// opened holds the paths of the Logs opened by Open, as each log must have a single writer
+var opened = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// Open opens, or creates, the audit log at the given path, continuing the chain from its last entry.
+// Entries are hashed with the given HMAC key, see Entry.
+// An error is returned if the log is already open, e.g. as the log of another tenant, as the chains of two writers
+// would be interleaved, or if the last entry cannot be read, as the chain could not be continued
+func Open(path string, key []byte) (*Log, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+
+	opened.Lock()
+	defer opened.Unlock()
+
+	if opened.paths[abs] {
+		return nil, fmt.Errorf("audit log %s is already open, each tenant must have its own audit log", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+
+	l := &Log{f: f, path: abs, key: key}
+	if err = l.resume(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	opened.paths[abs] = true
+
+	return l, nil
+}
+
+// resume reads the last entry of the log file, from which the chain continues
+func (l *Log) resume() error {
+	var last []byte
+	sc := bufio.NewScanner(l.f)
+	sc.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+	for sc.Scan() {
+		if len(sc.Bytes()) > 0 {
+			last = append(last[:0], sc.Bytes()...)
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("could not read audit log: %w", err)
+	}
+
+	if last == nil {
+		return nil
+	}
+
+	var e Entry
+	if err := json.Unmarshal(last, &e); err != nil {
+		return fmt.Errorf("could not read last audit log entry: %w", err)
+	}
+
+	// continuing with a different key would break the chain, so the last entry must match its hash with this key
+	if h, err := e.hash(l.key); err != nil || !hmac.Equal([]byte(h), []byte(e.Hash)) {
+		return fmt.Errorf("last audit log entry does not match its hash, the log was written with a different key")
+	}
+
+	l.seq, l.prev = e.Seq, e.Hash
+
+	return nil
+}
+
+// Write appends the entry to the log, setting its sequence number, time and hashes.
+// The file is synced before Write returns, so a recorded entry survives a crash
+func (l *Log) Write(e Entry) error {
+	l.Lock()
+	defer l.Unlock()
+
+	e.Seq = l.seq + 1
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	e.PrevHash = l.prev
+
+	var err error
+	if e.Hash, err = e.hash(l.key); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err = l.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	if err = l.f.Sync(); err != nil {
+		return err
+	}
+
+	l.seq, l.prev = e.Seq, e.Hash
+
+	return nil
+}
+
+// Close closes the log file, after which the log can be opened again
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	opened.Lock()
+	defer opened.Unlock()
+
+	delete(opened.paths, l.path)
+
+	return l.f.Close()
+}
+
+// Verify checks the hash chain of an audit log with the HMAC key it was written with, returning the number of entries
+// and the hash of the last entry. An error identifies the line of the first entry which is malformed, out of sequence,
+// or does not match its hash. Removal of entries from the end of the log cannot be detected by the chain alone;
+// compare the last hash with one recorded elsewhere
+func Verify(r io.Reader, key []byte) (n int, last string, err error) {
+	if err = checkKey(key); err != nil {
+		return 0, "", err
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+
+	var seq uint64
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+
+		var e Entry
+		if err = json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return n, last, fmt.Errorf("line %d: malformed entry: %w", line, err)
+		}
+
+		if e.Seq != seq+1 {
+			return n, last, fmt.Errorf("line %d: expected sequence number %d, got %d", line, seq+1, e.Seq)
+		}
+
+		if e.PrevHash != last {
+			return n, last, fmt.Errorf("line %d: previous hash does not match entry %d", line, seq)
+		}
+
+		h, err := e.hash(key)
+		if err != nil {
+			return n, last, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if !hmac.Equal([]byte(h), []byte(e.Hash)) {
+			return n, last, fmt.Errorf("line %d: entry %d does not match its hash", line, e.Seq)
+		}
+
+		seq, last = e.Seq, e.Hash
+		n++
+	}
+
+	if err = sc.Err(); err != nil {
+		return n, last, fmt.Errorf("could not read audit log: %w", err)
+	}
+
+	return n, last, nil
+}
@@ -0,0 +1,154 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// writeTestLog writes n entries to a new audit log and returns its path and lines
+func writeTestLog(t *testing.T, n int) (string, []string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		e := Entry{Event: EventValidation, Command: "EraseDevice", Udid: "UDID", Token: "loaner-erase", Outcome: OutcomeAccepted}
+		if err = l.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestVerify(t *testing.T) {
+	_, lines := writeTestLog(t, 3)
+
+	n, last, err := Verify(strings.NewReader(strings.Join(lines, "\n")), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 || last == "" || !strings.Contains(lines[2], last) {
+		t.Errorf("got %d entries with last hash %s, want 3 entries ending with the last line's hash", n, last)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	_, lines := writeTestLog(t, 3)
+
+	tests := []struct {
+		name  string
+		lines []string
+		key   []byte
+		want  string
+	}{
+		{
+			name:  "edited entry",
+			lines: []string{lines[0], strings.Replace(lines[1], "loaner-erase", "admin", 1), lines[2]},
+			key:   testKey,
+			want:  "line 2: entry 2 does not match its hash",
+		},
+		{
+			name:  "removed entry",
+			lines: []string{lines[0], lines[2]},
+			key:   testKey,
+			want:  "line 2: expected sequence number 2, got 3",
+		},
+		{
+			name:  "reordered entries",
+			lines: []string{lines[1], lines[0], lines[2]},
+			key:   testKey,
+			want:  "line 1: expected sequence number 1, got 2",
+		},
+		{
+			name:  "malformed entry",
+			lines: []string{lines[0], "{"},
+			key:   testKey,
+			want:  "line 2: malformed entry",
+		},
+		{
+			name:  "wrong key",
+			lines: lines,
+			key:   bytes.Repeat([]byte("k"), MinKeyBytes),
+			want:  "line 1: entry 1 does not match its hash",
+		},
+		{
+			name:  "short key",
+			lines: lines,
+			key:   []byte("short"),
+			want:  "audit log key must be at least",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Verify(strings.NewReader(strings.Join(tt.lines, "\n")), tt.key)
+			if err == nil {
+				t.Fatal("expected verification to fail")
+			}
+
+			if !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got error '%s', want '%s'", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenResumesChain(t *testing.T) {
+	path, _ := writeTestLog(t, 2)
+
+	l, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err = l.Write(Entry{Event: EventCommand, Outcome: OutcomeSent}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if n, _, err := Verify(f, testKey); err != nil || n != 3 {
+		t.Errorf("got %d entries, %v, want 3 valid entries", n, err)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	path, _ := writeTestLog(t, 1)
+
+	if _, err := Open(path, bytes.Repeat([]byte("k"), MinKeyBytes)); err == nil {
+		t.Error("expected an error continuing a log written with a different key")
+	}
+
+	shared := filepath.Join(t.TempDir(), "shared.jsonl")
+	l, err := Open(shared, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err = Open(shared, testKey); err == nil {
+		t.Error("expected an error opening a log which is already open")
+	}
+}
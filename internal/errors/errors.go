@@ -11,17 +11,35 @@ var (
 	JamfErrForbidden     = Jamf{Message: "forbidden", Status: http.StatusForbidden}
 	JamfErrBadRequest    = Jamf{Message: "bad request", Status: http.StatusBadRequest}
 	JamfErrUnhandled     = Jamf{Message: "unhandled Jamf error", Status: http.StatusInternalServerError}
+
+	JamfErrManagementIdNotFound = Jamf{Message: "management ID not found", Status: http.StatusNotFound}
+	JamfErrUnavailable          = Jamf{Message: "Jamf unavailable, it may be down for maintenance", Status: http.StatusServiceUnavailable}
+	JamfErrRateLimited          = Jamf{Message: "rate limited by Jamf", Status: http.StatusTooManyRequests}
+	// JamfErrAuthFailed is returned when this service cannot get a Jamf API token. It is a 502, so it is not mistaken
+	// for the client's own token being rejected
+	JamfErrAuthFailed = Jamf{Message: "could not authenticate with Jamf, check the Jamf API credentials", Status: http.StatusBadGateway}
 )
 
 var (
-	CodeNotFound     = Request{Message: "code not found", Status: http.StatusNotFound}
-	CodeExpired      = Request{Message: "code expired", Status: http.StatusGone}
-	CodeMismatch     = Request{Message: "code mismatch", Status: http.StatusBadRequest}
-	UdidNotSpecified = Request{Message: "UDID not specified", Status: http.StatusBadRequest}
-	UdidInvalid      = Request{Message: "UDID invalid", Status: http.StatusBadRequest}
-	ExtAttrNotFound  = Request{Message: "extension attribute not found", Status: http.StatusNotFound}
-	BadToken         = Request{Message: "malformed or missing token", Status: http.StatusBadRequest}
-	InvalidToken     = Request{Message: "invalid token", Status: http.StatusUnauthorized}
+	CodeNotFound      = Request{Message: "code not found", Status: http.StatusNotFound}
+	CodeExpired       = Request{Message: "code expired", Status: http.StatusGone}
+	CodeMismatch      = Request{Message: "code mismatch", Status: http.StatusBadRequest}
+	UdidNotSpecified  = Request{Message: "UDID not specified", Status: http.StatusBadRequest}
+	UdidInvalid       = Request{Message: "UDID invalid", Status: http.StatusBadRequest}
+	ExtAttrNotFound   = Request{Message: "extension attribute not found", Status: http.StatusNotFound}
+	BadToken          = Request{Message: "malformed or missing token", Status: http.StatusBadRequest}
+	InvalidToken      = Request{Message: "invalid token", Status: http.StatusUnauthorized}
+	PinNotFound       = Request{Message: "no escrowed PIN found", Status: http.StatusNotFound}
+	LockedOut         = Request{Message: "too many attempts, try again later", Status: http.StatusTooManyRequests}
+	CommandCooldown   = Request{Message: "command recently sent to this device, try again later", Status: http.StatusTooManyRequests}
+	BudgetExceeded    = Request{Message: "destructive command budget exceeded, an admin must reset it", Status: http.StatusServiceUnavailable}
+	JobNotFound       = Request{Message: "job not found", Status: http.StatusNotFound}
+	CommandUnknown    = Request{Message: "command not recognised", Status: http.StatusBadRequest}
+	BodyInvalid       = Request{Message: "request body is not valid JSON or contains unknown fields", Status: http.StatusBadRequest}
+	TokenExpired      = Request{Message: "token expired", Status: http.StatusUnauthorized}
+	TokenSourceDenied = Request{Message: "token not allowed from this address", Status: http.StatusForbidden}
+	CommandNotEnabled = Request{Message: "command not enabled", Status: http.StatusForbidden}
+	TokenScopeDenied  = Request{Message: "token not allowed to send this command", Status: http.StatusForbidden}
 )
 
 var (
@@ -32,11 +50,23 @@ var (
 	UpdateConfigActionBad            = Request{Message: "updateAction value not recognised", Status: http.StatusBadRequest}
 )
 
+var (
+	UpdatePolicyVersionNotAllowed      = Request{Message: "targetVersion not allowed by software update policy", Status: http.StatusForbidden}
+	UpdatePolicyMajorNotAllowed        = Request{Message: "major updates not allowed by software update policy", Status: http.StatusForbidden}
+	UpdatePolicyForceRestartNotAllowed = Request{Message: "forceRestart not allowed by software update policy at this time", Status: http.StatusForbidden}
+	UpdatePolicyMaxDeferralsExceeded   = Request{Message: "maxDeferrals exceeds software update policy maximum", Status: http.StatusForbidden}
+)
+
 var (
 	RequestSendFailed   = Service{Message: "failed to send request"}
 	RequestCreateFailed = Service{Message: "failed to create request"}
 	BodyDecodeFailed    = Service{Message: "failed to decode response body"}
 	CodeGenFailed       = Service{Message: "failed to generate code"}
+	PinGenFailed        = Service{Message: "failed to generate PIN"}
+	CodeStoreFailed     = Service{Message: "code store operation failed"}
+	StateStoreFailed    = Service{Message: "lockout or command guard state operation failed"}
+	AuditWriteFailed    = Service{Message: "could not write audit log, command not sent"}
+	JamfCircuitOpen     = Service{Message: "Jamf is unavailable, requests are failing fast until it recovers"}
 )
 
 // Jamf is an error type for errors returned by Jamf
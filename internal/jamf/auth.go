@@ -0,0 +1,116 @@
+package jamf
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/logger"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	endpointOAuthToken = "/oauth/token"
+	// defaultRefreshMargin is how long before expiry a token is renewed
+	defaultRefreshMargin = 120
+)
+
+// Auth is a method of authenticating with the Jamf API
+type Auth interface {
+	// renewToken returns a new token, given the client's current token which may have expired
+	renewToken(c *Client, current *Token) (*Token, error)
+}
+
+// BasicAuth authenticates with the username and password of a Jamf user account.
+// Tokens are claimed at /v1/auth/token and refreshed before expiry with the keep-alive endpoint
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a BasicAuth) renewToken(c *Client, current *Token) (*Token, error) {
+	req, _ := http.NewRequest(http.MethodPost, "", nil)
+	var endpoint string
+
+	if current.expired() {
+		endpoint = endpointToken
+		req.SetBasicAuth(a.Username, a.Password)
+		logger.Debug("Jamf token expired, using Basic Auth to renew")
+	} else {
+		endpoint = endpointKeepAlive
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", current.Value))
+		logger.Debug("Jamf token nearing expiry, refreshing using current token")
+	}
+
+	req.URL, _ = url.Parse(c.apiBaseUrl(ProAPI) + endpoint)
+
+	var t Token
+	if err := c.requestToken(req, &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// ClientCredentials authenticates with the client ID and secret of a Jamf API client, created under
+// API Roles and Clients. Tokens are claimed at /api/oauth/token with the client credentials grant;
+// there is no keep-alive for these tokens, so a new token is claimed before the current token expires
+type ClientCredentials struct {
+	ClientId     string
+	ClientSecret string
+}
+
+// oauthToken is the response body of the Jamf OAuth token endpoint
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (a ClientCredentials) renewToken(c *Client, current *Token) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", a.ClientId)
+	form.Set("client_secret", a.ClientSecret)
+
+	req, _ := http.NewRequest(http.MethodPost, c.apiBaseUrl(ProAPI)+endpointOAuthToken, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	logger.Debug("Jamf token expired or nearing expiry, using client credentials to renew")
+
+	var ot oauthToken
+	if err := c.requestToken(req, &ot); err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		Value:   ot.AccessToken,
+		Expires: time.Now().Add(time.Duration(ot.ExpiresIn) * time.Second).Format(time.RFC3339),
+	}, nil
+}
+
+// requestToken sends a token request to Jamf and decodes the response into v.
+// The request is bound to the Client's context, see WithContext
+func (c *Client) requestToken(req *http.Request, v interface{}) error {
+	if c.ctx != nil {
+		req = req.WithContext(c.ctx)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.RequestSendFailed.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Errorf("Jamf API token request failed: %s", resp.Status)
+		return errors.JamfErrAuthFailed
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.BodyDecodeFailed.Wrap(err)
+	}
+
+	return nil
+}
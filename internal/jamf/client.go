@@ -1,12 +1,17 @@
 package jamf
 
 import (
+	"bytes"
 	"command-on-demand/internal/errors"
 	"command-on-demand/internal/logger"
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,32 +24,47 @@ const (
 
 type Client struct {
 	fqdn       string
-	auth       BasicAuth
-	token      *Token
+	tokens     *tokenManager
+	options    ClientOptions
+	breaker    *breaker
 	httpClient *http.Client
+	ctx        context.Context
+	// policyLookup is shared with copies of the Client, see SetPolicyLookup
+	policyLookup *atomic.Bool
 }
 
-type BasicAuth struct {
-	Username string
-	Password string
-}
-
-func NewClient(fqdn string, auth BasicAuth) (*Client, error) {
+// NewClient creates a Client for the given Jamf instance, authenticating with either BasicAuth or ClientCredentials.
+// A token is claimed straight away, so an error is returned if the credentials are not accepted
+func NewClient(fqdn string, auth Auth, opts ClientOptions) (*Client, error) {
 	c := &Client{
-		fqdn: fqdn,
-		auth: auth,
+		fqdn:    fqdn,
+		tokens:  newTokenManager(auth),
+		options: opts,
+		breaker: newBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
 		httpClient: &http.Client{
-			Timeout: time.Second * 10,
+			Timeout:   opts.Timeout,
+			Transport: opts.Transport,
 		},
+		policyLookup: &atomic.Bool{},
 	}
 
-	if err := c.handleToken(); err != nil {
+	if _, err := c.tokens.get(c); err != nil {
 		return nil, err
 	}
 
 	return c, nil
 }
 
+// WithContext returns a copy of the Client whose requests, including retries, are bound to the given context.
+// The copy shares its token, circuit breaker and connections with the Client. Retries are not attempted when
+// their delay would pass the context's deadline, so a caller can bound the total time spent waiting on Jamf
+func (c *Client) WithContext(ctx context.Context) *Client {
+	cc := *c
+	cc.ctx = ctx
+
+	return &cc
+}
+
 func (c *Client) baseUrl() *url.URL {
 	return &url.URL{
 		Scheme: "https",
@@ -61,73 +81,72 @@ func (c *Client) apiBaseUrl(suffix string) string {
 	return u.String()
 }
 
-// handleToken wraps all functionality for checking token validity and subsequent API calls to claim and renew tokens
-func (c *Client) handleToken() error {
-	if c.token == nil {
-		c.token = &Token{}
-	}
-
-	if !c.token.expired() && !c.token.expiringSoon() {
-		return nil
+// sendRequest is a helper function for dispatching requests
+// centralises logic for handling tokens, headers, retries and request/response body parsing.
+// Requests are retried as described by retryable, and fail fast while the circuit breaker is open
+func (c *Client) sendRequest(req *http.Request, v interface{}) error {
+	if c.ctx != nil {
+		req = req.WithContext(c.ctx)
 	}
 
-	req, _ := http.NewRequest(http.MethodPost, "", nil)
-	req.Header.Set("Accept", "application/json")
-	var endpoint string
-
-	if c.token.expired() {
-		endpoint = endpointToken
-		req.SetBasicAuth(c.auth.Username, c.auth.Password)
-		logger.Debug("Jamf token expired, using Basic Auth to renew")
-	} else {
-		endpoint = endpointKeepAlive
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token.Value))
-		logger.Debug("Jamf token nearing expiry, refreshing using current token")
-	}
+	for attempt := 0; ; attempt++ {
+		if !c.breaker.allow() {
+			return errors.JamfCircuitOpen
+		}
 
-	req.URL, _ = url.Parse(c.apiBaseUrl(ProAPI) + endpoint)
+		token, err := c.tokens.get(c)
+		if err != nil {
+			logger.Errorf("failed to get Jamf API token: %s", err)
+			return err
+		}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return errors.RequestSendFailed.Wrap(err)
-	}
-	defer resp.Body.Close()
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	if resp.StatusCode != http.StatusOK {
-		return errors.Jamf{
-			Message: "error when requesting API token",
-			Status:  resp.StatusCode,
+		if attempt > 0 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return errors.RequestCreateFailed.Wrap(err)
+			}
 		}
-	}
 
-	var t Token
+		resp, err := c.httpClient.Do(req)
+		c.breaker.record(err == nil && resp.StatusCode < 500)
 
-	if err = json.NewDecoder(resp.Body).Decode(&t); err != nil {
-		return errors.BodyDecodeFailed.Wrap(err)
-	}
+		if attempt < c.options.MaxRetries && retryable(req, resp, err) && (req.Body == nil || req.GetBody != nil) {
+			delay := c.options.backoff(attempt)
+			if ra, ok := retryAfter(resp); ok {
+				delay = ra
+			}
 
-	c.token = &t
-	logger.Debug("successfully acquired new Jamf API token")
+			if delay <= maxRetryAfter && beforeDeadline(req.Context(), delay) {
+				reason := fmt.Sprint(err)
+				if resp != nil {
+					reason = resp.Status
+					resp.Body.Close()
+				}
+				logger.Warnf("Jamf %s %s failed (%s), retrying in %s", req.Method, req.URL.Path, reason, delay.Round(time.Millisecond))
+				time.Sleep(delay)
+				continue
+			}
+		}
 
-	return nil
-}
+		if err != nil {
+			return errors.RequestSendFailed.Wrap(err)
+		}
 
-// sendRequest is a helper function for dispatching requests
-// centralises logic for handling tokens, headers and request/response body parsing
-func (c *Client) sendRequest(req *http.Request, v interface{}) error {
-	err := c.handleToken()
-	if err != nil {
-		logger.Fatalf("failed to get token: %s", err)
+		return handleResponse(resp, v)
 	}
+}
 
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token.Value))
+// beforeDeadline returns true if waiting for the given delay would leave time before the context's deadline, if any
+func beforeDeadline(ctx context.Context, delay time.Duration) bool {
+	deadline, ok := ctx.Deadline()
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return errors.RequestSendFailed.Wrap(err)
-	}
+	return !ok || time.Now().Add(delay).Before(deadline)
+}
 
+// handleResponse maps the status of a Jamf response to an error, or decodes its body into v
+func handleResponse(resp *http.Response, v interface{}) (err error) {
 	defer resp.Body.Close()
 
 	// jamf API does not always return a usable error response body, so we need to map common status codes to errors
@@ -141,6 +160,10 @@ func (c *Client) sendRequest(req *http.Request, v interface{}) error {
 			return errors.JamfErrForbidden
 		case http.StatusBadRequest:
 			return errors.JamfErrBadRequest
+		case http.StatusTooManyRequests:
+			return errors.JamfErrRateLimited
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return errors.JamfErrUnavailable
 		default:
 			return errors.Jamf{
 				Message: errors.JamfErrUnhandled.Message,
@@ -160,9 +183,28 @@ func (c *Client) sendRequest(req *http.Request, v interface{}) error {
 	return nil
 }
 
-// GetComputer retrieves a Computer record from Jamf API, or returns an error
+// GetComputer retrieves a Computer record from Jamf API, or returns an error.
+// The record is retrieved from the Jamf Pro computers inventory, or the Classic API, see ClientOptions.ComputerLookup
 func (c *Client) GetComputer(udid string) (Computer, error) {
-	u, _ := url.JoinPath(c.apiBaseUrl(ClassicAPI), "computers", "udid", udid)
+	if c.options.ComputerLookup == ComputerLookupClassic {
+		return c.getComputer("udid", udid)
+	}
+
+	return c.getComputerInventory("udid", udid)
+}
+
+// GetComputerBySerial retrieves a Computer record from Jamf API by its serial number, or returns an error
+func (c *Client) GetComputerBySerial(serial string) (Computer, error) {
+	if c.options.ComputerLookup == ComputerLookupClassic {
+		return c.getComputer("serialnumber", serial)
+	}
+
+	return c.getComputerInventory("hardware.serialNumber", serial)
+}
+
+// getComputer retrieves a Computer record from the Classic API, matched on the given identifier type
+func (c *Client) getComputer(match string, value string) (Computer, error) {
+	u, _ := url.JoinPath(c.apiBaseUrl(ClassicAPI), "computers", match, value)
 	s := struct {
 		Computer Computer `json:"computer"`
 	}{}
@@ -179,6 +221,86 @@ func (c *Client) GetComputer(udid string) (Computer, error) {
 	return s.Computer, nil
 }
 
+// SetExtensionAttribute sets the value of the named extension attribute on the given Computer's record.
+// The extension attribute must use the Text Field input type, otherwise Jamf will overwrite the value on the next recon
+func (c *Client) SetExtensionAttribute(comp Computer, name string, value string) error {
+	u, _ := url.JoinPath(c.apiBaseUrl(ClassicAPI), "computers", "id", strconv.Itoa(comp.Id))
+
+	var x struct {
+		XMLName             struct{}             `xml:"computer"`
+		ExtensionAttributes []ExtensionAttribute `xml:"extension_attributes>extension_attribute"`
+	}
+	x.ExtensionAttributes = []ExtensionAttribute{{Name: name, Value: value}}
+
+	body, err := xml.Marshal(&x)
+	if err != nil {
+		return errors.RequestCreateFailed.Wrap(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return errors.RequestCreateFailed.Wrap(err)
+	}
+
+	req.Header.Set("Content-Type", "application/xml")
+
+	return c.sendRequest(req, nil)
+}
+
+// ResolveManagementId looks up the management ID for the given Computer with the Jamf Pro API and sets it on the Computer.
+// The management ID is required by commands sent with the Jamf Pro MDM commands API
+func (c *Client) ResolveManagementId(comp *Computer) error {
+	if comp.ManagementId != "" {
+		return nil
+	}
+
+	u, _ := url.JoinPath(c.apiBaseUrl(ProAPI), "v1", "computers-inventory", strconv.Itoa(comp.Id))
+	s := struct {
+		General struct {
+			ManagementId string `json:"managementId"`
+		} `json:"general"`
+	}{}
+
+	req, err := http.NewRequest("GET", u+"?section=GENERAL", nil)
+	if err != nil {
+		return errors.RequestCreateFailed.Wrap(err)
+	}
+
+	if err = c.sendRequest(req, &s); err != nil {
+		return err
+	}
+
+	if s.General.ManagementId == "" {
+		return errors.JamfErrManagementIdNotFound
+	}
+
+	comp.ManagementId = s.General.ManagementId
+
+	return nil
+}
+
+// GetMdmCommands retrieves the MDM command history, including pending commands, for the given management ID
+func (c *Client) GetMdmCommands(managementId string) ([]MdmCommand, error) {
+	u, _ := url.JoinPath(c.apiBaseUrl(ProAPI), "v2", "mdm", "commands")
+	q := url.Values{}
+	q.Set("filter", fmt.Sprintf(`clientManagementId=="%s"`, managementId))
+
+	s := struct {
+		Results []MdmCommand `json:"results"`
+	}{}
+
+	req, err := http.NewRequest("GET", u+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, errors.RequestCreateFailed.Wrap(err)
+	}
+
+	if err = c.sendRequest(req, &s); err != nil {
+		return nil, err
+	}
+
+	return s.Results, nil
+}
+
 func (c *Client) SendCommand(cmd Commander) error {
 	req, err := cmd.Request()
 	if err != nil {
@@ -0,0 +1,177 @@
+package jamf
+
+import (
+	"command-on-demand/internal/errors"
+	"context"
+	"encoding/json"
+	e "errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClientOptions are ClientOptions with short retry delays and the circuit breaker disabled
+func testClientOptions() ClientOptions {
+	opts := DefaultClientOptions()
+	opts.RetryBaseDelay = time.Millisecond
+	opts.RetryMaxDelay = time.Millisecond
+	opts.BreakerThreshold = 0
+
+	return opts
+}
+
+// newTestClient returns a Client for a fake Jamf API which issues tokens with basic auth and serves other requests
+// with the given handler
+func newTestClient(t *testing.T, h http.HandlerFunc, opts ClientOptions) *Client {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+ProAPI+endpointToken {
+			json.NewEncoder(w).Encode(Token{Value: "token", Expires: time.Now().Add(time.Hour).Format(time.RFC3339)})
+			return
+		}
+		h(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	opts.Transport = srv.Client().Transport
+	c, err := NewClient(strings.TrimPrefix(srv.URL, "https://"), BasicAuth{Username: "u", Password: "p"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// statusSequence returns a handler which responds with each status in turn, repeating the last, and counts requests
+func statusSequence(attempts *atomic.Int32, header http.Header, statuses ...int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := int(attempts.Add(1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(statuses[n-1])
+	}
+}
+
+// send sends a request with the given method to the Client's Jamf API
+func send(t *testing.T, c *Client, method string) error {
+	t.Helper()
+
+	req, err := http.NewRequest(method, c.apiBaseUrl(ProAPI)+"/test", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.sendRequest(req, nil)
+}
+
+func TestSendRequestRetries(t *testing.T) {
+	var attempts atomic.Int32
+	c := newTestClient(t, statusSequence(&attempts, nil, 503, 503, 200), testClientOptions())
+
+	if err := send(t, c, http.MethodGet); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestSendRequestRetriesExhausted(t *testing.T) {
+	var attempts atomic.Int32
+	c := newTestClient(t, statusSequence(&attempts, nil, 503), testClientOptions())
+
+	if err := send(t, c, http.MethodGet); !e.Is(err, errors.JamfErrUnavailable) {
+		t.Errorf("expected Jamf unavailable, got %v", err)
+	}
+
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("expected the request and 2 retries, got %d attempts", n)
+	}
+}
+
+func TestSendRequestNonIdempotent(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int32
+	}{
+		{name: "server error not retried", status: 503, attempts: 1},
+		{name: "rate limit retried", status: 429, attempts: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			c := newTestClient(t, statusSequence(&attempts, nil, tt.status), testClientOptions())
+
+			if err := send(t, c, http.MethodPost); err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if n := attempts.Load(); n != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, n)
+			}
+		})
+	}
+}
+
+func TestSendRequestRetryAfter(t *testing.T) {
+	var attempts atomic.Int32
+	header := http.Header{"Retry-After": []string{"1"}}
+	c := newTestClient(t, statusSequence(&attempts, header, 429, 200), testClientOptions())
+
+	start := time.Now()
+	if err := send(t, c, http.MethodGet); err != nil {
+		t.Fatal(err)
+	}
+
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("expected the retry to wait for Retry-After, waited %s", waited)
+	}
+
+	// a Retry-After past the deadline is not waited for
+	attempts.Store(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	if err := send(t, c.WithContext(ctx), http.MethodGet); !e.Is(err, errors.JamfErrRateLimited) {
+		t.Errorf("expected rate limited without a retry, got %v", err)
+	}
+
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("expected 1 attempt before the deadline, got %d", n)
+	}
+}
+
+func TestSendRequestBreaker(t *testing.T) {
+	var attempts atomic.Int32
+	opts := testClientOptions()
+	opts.MaxRetries = 0
+	opts.BreakerThreshold = 2
+	opts.BreakerCooldown = time.Hour
+	c := newTestClient(t, statusSequence(&attempts, nil, 500), opts)
+
+	for i := 0; i < 2; i++ {
+		if err := send(t, c, http.MethodGet); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	if err := send(t, c, http.MethodGet); !e.Is(err, errors.JamfCircuitOpen) {
+		t.Errorf("expected the circuit breaker to be open, got %v", err)
+	}
+
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("expected no request while the circuit breaker is open, got %d attempts", n)
+	}
+}
@@ -7,7 +7,11 @@ import (
 // Commander is the interface for all Jamf commands
 // Body returns the unmarshalled XML or JSON command body, or empty []byte for an empty body
 // Request returns a new http.Request with the appropriate path, headers and body
+// CommandType returns the MDM command type as reported in the device's command history, see Client.GetMdmCommands
+// Parameters returns the command's parameters for audit records, never including secrets such as PINs
 type Commander interface {
 	Body() ([]byte, error)
 	Request() (*http.Request, error)
+	CommandType() string
+	Parameters() map[string]string
 }
@@ -5,8 +5,8 @@ import (
 )
 
 type ExtensionAttribute struct {
-	Name  string `json:"name"`
-	Value string `json:"value"`
+	Name  string `json:"name" xml:"name"`
+	Value string `json:"value" xml:"value"`
 }
 
 type General struct {
@@ -14,11 +14,26 @@ type General struct {
 	Udid         string `json:"udid"`
 	Name         string `json:"name"`
 	SerialNumber string `json:"serial_number"`
+	Supervised   bool   `json:"supervised"`
+}
+
+type Hardware struct {
+	Model     string `json:"model"`
+	OsVersion string `json:"os_version"`
+}
+
+type GroupsAccounts struct {
+	ComputerGroupMemberships []string `json:"computer_group_memberships"`
 }
 
 type Computer struct {
 	General             `json:"general"`
+	Hardware            `json:"hardware"`
+	GroupsAccounts      `json:"groups_accounts"`
 	ExtensionAttributes []ExtensionAttribute `json:"extension_attributes"`
+	// ManagementId is not part of the Classic API record, see Client.ResolveManagementId.
+	// It is set on computers retrieved from the Jamf Pro computers inventory
+	ManagementId string `json:"-"`
 }
 
 // GetExtensionAttribute returns the value for a given extension attribute name, or an error if that EA was not found
@@ -31,3 +46,14 @@ func (c Computer) GetExtensionAttribute(name string) (string, error) {
 
 	return "", errors.ExtAttrNotFound
 }
+
+// InGroup returns true if the computer is a member of the given computer group
+func (c Computer) InGroup(name string) bool {
+	for _, g := range c.ComputerGroupMemberships {
+		if g == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+package jamf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+)
+
+type DeviceLockCommand struct {
+	computer    Computer
+	passcode    string
+	message     string
+	phoneNumber string
+}
+
+// NewDeviceLockCommand returns a new DeviceLockCommand.
+// message and phoneNumber are optional and are shown on the lock screen when set
+func NewDeviceLockCommand(comp Computer, pin string, message string, phoneNumber string) DeviceLockCommand {
+	var c = DeviceLockCommand{}
+
+	c.computer = comp
+	c.passcode = pin
+	c.message = message
+	c.phoneNumber = phoneNumber
+
+	return c
+}
+
+func (c DeviceLockCommand) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	// https://developer.jamf.com/jamf-pro/reference/createcomputercommandbycommand
+	var x struct {
+		XMLName struct{} `xml:"computer_command"`
+		General struct {
+			Command     string `xml:"command"`
+			Passcode    string `xml:"passcode"`
+			LockMessage string `xml:"lock_message,omitempty"`
+			PhoneNumber string `xml:"phone_number,omitempty"`
+		} `xml:"general"`
+		Computers struct {
+			Computer struct {
+				Id int `xml:"id"`
+			} `xml:"computer"`
+		} `xml:"computers"`
+	}
+
+	x.Computers.Computer.Id = c.computer.Id
+	x.General.Command = "DeviceLock"
+	x.General.Passcode = c.passcode
+	x.General.LockMessage = c.message
+	x.General.PhoneNumber = c.phoneNumber
+
+	return e.Encode(&x)
+}
+
+// Body returns the XML body for the DeviceLockCommand
+func (c DeviceLockCommand) Body() ([]byte, error) {
+	return xml.Marshal(c)
+}
+
+// Request builds a new http.Request for the DeviceLockCommand with its relative API path, headers and body
+func (c DeviceLockCommand) Request() (*http.Request, error) {
+	u, err := url.JoinPath(ClassicAPI, "computercommands", "command", "DeviceLock")
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Content-Type", "application/xml")
+
+	return req, nil
+}
+
+// Parameters returns the lock screen message and phone number of the DeviceLockCommand, without its PIN
+func (c DeviceLockCommand) Parameters() map[string]string {
+	return map[string]string{
+		"message":     c.message,
+		"phoneNumber": c.phoneNumber,
+	}
+}
+
+// Pin returns the PIN the DeviceLockCommand locks the computer with
+func (c DeviceLockCommand) Pin() string {
+	return c.passcode
+}
+
+// CommandType returns the MDM command type for the DeviceLockCommand
+func (c DeviceLockCommand) CommandType() string {
+	return MdmCommandDeviceLock
+}
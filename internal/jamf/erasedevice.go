@@ -5,6 +5,7 @@ import (
 	"encoding/xml"
 	"net/http"
 	"net/url"
+	"strconv"
 )
 
 type EraseDeviceCommand struct {
@@ -70,3 +71,128 @@ func (c EraseDeviceCommand) Request() (*http.Request, error) {
 
 	return req, nil
 }
+
+const (
+	MdmCommandEraseDevice = "ERASE_DEVICE"
+
+	ObliterationDefault               = "Default"
+	ObliterationDoNotObliterate       = "DoNotObliterate"
+	ObliterationObliterateWithWarning = "ObliterateWithWarning"
+	ObliterationAlways                = "Always"
+)
+
+// EraseDeviceOptions are the options supported by the Jamf Pro MDM commands API for EraseDevice.
+// WifiProfileData is the raw Wi-Fi configuration profile used by Return to Service
+type EraseDeviceOptions struct {
+	ObliterationBehavior   string
+	PreserveDataPlan       bool
+	DisallowProximitySetup bool
+	ReturnToService        bool
+	WifiProfileData        []byte
+}
+
+// EraseDeviceMdmCommand is an EraseDevice command sent with the Jamf Pro MDM commands API
+type EraseDeviceMdmCommand struct {
+	computer Computer
+	passcode string
+	options  EraseDeviceOptions
+}
+
+type returnToService struct {
+	Enabled         bool   `json:"enabled"`
+	WifiProfileData []byte `json:"wifiProfileData,omitempty"`
+}
+
+type eraseDeviceCommandData struct {
+	CommandType            string           `json:"commandType"`
+	Pin                    string           `json:"pin,omitempty"`
+	ObliterationBehavior   string           `json:"obliterationBehavior,omitempty"`
+	PreserveDataPlan       bool             `json:"preserveDataPlan"`
+	DisallowProximitySetup bool             `json:"disallowProximitySetup"`
+	ReturnToService        *returnToService `json:"returnToService,omitempty"`
+}
+
+// ValidObliterationBehavior returns true if b is a recognised obliterationBehavior value
+func ValidObliterationBehavior(b string) bool {
+	switch b {
+	case ObliterationDefault, ObliterationDoNotObliterate, ObliterationObliterateWithWarning, ObliterationAlways:
+		return true
+	}
+
+	return false
+}
+
+// NewEraseDeviceMdmCommand returns a new EraseDeviceMdmCommand.
+// The computer must have its ManagementId resolved, see Client.ResolveManagementId
+func NewEraseDeviceMdmCommand(comp Computer, pin string, opts EraseDeviceOptions) EraseDeviceMdmCommand {
+	return EraseDeviceMdmCommand{
+		computer: comp,
+		passcode: pin,
+		options:  opts,
+	}
+}
+
+// Body returns the JSON body for the EraseDeviceMdmCommand
+func (c EraseDeviceMdmCommand) Body() ([]byte, error) {
+	d := eraseDeviceCommandData{
+		CommandType:            MdmCommandEraseDevice,
+		Pin:                    c.passcode,
+		ObliterationBehavior:   c.options.ObliterationBehavior,
+		PreserveDataPlan:       c.options.PreserveDataPlan,
+		DisallowProximitySetup: c.options.DisallowProximitySetup,
+	}
+
+	if c.options.ReturnToService {
+		d.ReturnToService = &returnToService{
+			Enabled:         true,
+			WifiProfileData: c.options.WifiProfileData,
+		}
+	}
+
+	return newMdmCommandBody(c.computer.ManagementId, d)
+}
+
+// Request builds a new http.Request for the EraseDeviceMdmCommand
+func (c EraseDeviceMdmCommand) Request() (*http.Request, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+
+	return newMdmCommandRequest(body)
+}
+
+// Parameters returns the parameters of the EraseDeviceCommand, which has none besides its PIN
+func (c EraseDeviceCommand) Parameters() map[string]string {
+	return nil
+}
+
+// Parameters returns the erase options of the EraseDeviceMdmCommand, without its PIN or Wi-Fi profile
+func (c EraseDeviceMdmCommand) Parameters() map[string]string {
+	return map[string]string{
+		"obliterationBehavior":   c.options.ObliterationBehavior,
+		"preserveDataPlan":       strconv.FormatBool(c.options.PreserveDataPlan),
+		"disallowProximitySetup": strconv.FormatBool(c.options.DisallowProximitySetup),
+		"returnToService":        strconv.FormatBool(c.options.ReturnToService),
+	}
+}
+
+// Pin returns the PIN the EraseDeviceCommand sets on the computer
+func (c EraseDeviceCommand) Pin() string {
+	return c.passcode
+}
+
+// Pin returns the PIN the EraseDeviceMdmCommand sets on the computer
+func (c EraseDeviceMdmCommand) Pin() string {
+	return c.passcode
+}
+
+// CommandType returns the MDM command type for the EraseDeviceCommand
+func (c EraseDeviceCommand) CommandType() string {
+	return MdmCommandEraseDevice
+}
+
+// CommandType returns the MDM command type for the EraseDeviceMdmCommand
+func (c EraseDeviceMdmCommand) CommandType() string {
+	return MdmCommandEraseDevice
+}
@@ -0,0 +1,138 @@
+package jamf
+
+import (
+	"command-on-demand/internal/errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Computer lookup backends, see ClientOptions.ComputerLookup
+const (
+	ComputerLookupPro     = "pro"
+	ComputerLookupClassic = "classic"
+)
+
+// inventorySections are the computers inventory sections requested when looking up a computer.
+// GENERAL holds the record, management ID and supervision state, EXTENSION_ATTRIBUTES the code proof and escrowed PIN,
+// HARDWARE the serial number, which identifies computers in logs, audit entries and PIN lookups,
+// and OPERATING_SYSTEM the OS version
+var inventorySections = []string{
+	"GENERAL",
+	"EXTENSION_ATTRIBUTES",
+	"HARDWARE",
+	"OPERATING_SYSTEM",
+}
+
+// policySections are the computers inventory sections only requested when the software update policy uses them,
+// see Client.SetPolicyLookup. GROUP_MEMBERSHIPS holds the computer groups
+var policySections = []string{
+	"GROUP_MEMBERSHIPS",
+}
+
+// inventoryRecord is the subset of a Jamf Pro computers inventory record used to populate a Computer
+type inventoryRecord struct {
+	Id      string `json:"id"`
+	Udid    string `json:"udid"`
+	General struct {
+		Name         string `json:"name"`
+		ManagementId string `json:"managementId"`
+		Supervised   bool   `json:"supervised"`
+	} `json:"general"`
+	Hardware struct {
+		Model        string `json:"model"`
+		SerialNumber string `json:"serialNumber"`
+	} `json:"hardware"`
+	OperatingSystem struct {
+		Version string `json:"version"`
+	} `json:"operatingSystem"`
+	GroupMemberships []struct {
+		GroupName string `json:"groupName"`
+	} `json:"groupMemberships"`
+	ExtensionAttributes []struct {
+		Name   string   `json:"name"`
+		Values []string `json:"values"`
+	} `json:"extensionAttributes"`
+}
+
+// computer converts the inventory record to a Computer
+func (r inventoryRecord) computer() (c Computer, err error) {
+	if c.Id, err = strconv.Atoi(r.Id); err != nil {
+		return c, errors.BodyDecodeFailed.Wrap(err)
+	}
+
+	c.Udid = r.Udid
+	c.Name = r.General.Name
+	c.SerialNumber = r.Hardware.SerialNumber
+	c.Supervised = r.General.Supervised
+	c.Model = r.Hardware.Model
+	c.OsVersion = r.OperatingSystem.Version
+	c.ManagementId = r.General.ManagementId
+
+	for _, g := range r.GroupMemberships {
+		c.ComputerGroupMemberships = append(c.ComputerGroupMemberships, g.GroupName)
+	}
+
+	for _, ea := range r.ExtensionAttributes {
+		var v string
+		if len(ea.Values) > 0 {
+			v = ea.Values[0]
+		}
+		c.ExtensionAttributes = append(c.ExtensionAttributes, ExtensionAttribute{Name: ea.Name, Value: v})
+	}
+
+	return c, nil
+}
+
+// getComputerInventory retrieves a Computer record from the Jamf Pro computers inventory, filtered on the given
+// RSQL field. Only the sections in inventorySections, and policySections when enabled, are requested,
+// rather than the full record
+func (c *Client) getComputerInventory(field string, value string) (Computer, error) {
+	u, _ := url.JoinPath(c.apiBaseUrl(ProAPI), "v1", "computers-inventory")
+
+	q := url.Values{}
+	q.Set("filter", fmt.Sprintf(`%s=="%s"`, field, rsqlEscape(value)))
+	q.Set("page-size", "1")
+	for _, section := range inventorySections {
+		q.Add("section", section)
+	}
+	if c.policyLookup.Load() {
+		for _, section := range policySections {
+			q.Add("section", section)
+		}
+	}
+
+	s := struct {
+		TotalCount int               `json:"totalCount"`
+		Results    []inventoryRecord `json:"results"`
+	}{}
+
+	req, err := http.NewRequest("GET", u+"?"+q.Encode(), nil)
+	if err != nil {
+		return Computer{}, errors.RequestCreateFailed.Wrap(err)
+	}
+
+	if err = c.sendRequest(req, &s); err != nil {
+		return Computer{}, err
+	}
+
+	if len(s.Results) == 0 {
+		return Computer{}, errors.JamfErrNotFound
+	}
+
+	return s.Results[0].computer()
+}
+
+// SetPolicyLookup sets whether computer lookups with the Jamf Pro computers inventory request the group memberships,
+// which are only needed when the software update policy denies major updates.
+// The Classic API computer record always includes them
+func (c *Client) SetPolicyLookup(on bool) {
+	c.policyLookup.Store(on)
+}
+
+// rsqlEscape escapes a value for use in a double-quoted RSQL filter argument
+func rsqlEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v)
+}
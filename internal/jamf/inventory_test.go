@@ -0,0 +1,40 @@
+package jamf
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetComputerInventorySections(t *testing.T) {
+	var sections []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		sections = r.URL.Query()["section"]
+		w.Write([]byte(`{"totalCount":1,"results":[{"id":"1","udid":"UDID","operatingSystem":{"version":"14.4.1"}}]}`))
+	}, testClientOptions())
+
+	tests := []struct {
+		policyLookup bool
+		want         string
+	}{
+		{policyLookup: false, want: "GENERAL,EXTENSION_ATTRIBUTES,HARDWARE,OPERATING_SYSTEM"},
+		{policyLookup: true, want: "GENERAL,EXTENSION_ATTRIBUTES,HARDWARE,OPERATING_SYSTEM,GROUP_MEMBERSHIPS"},
+	}
+
+	for _, tt := range tests {
+		c.SetPolicyLookup(tt.policyLookup)
+
+		comp, err := c.GetComputer("UDID")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := strings.Join(sections, ","); got != tt.want {
+			t.Errorf("policy lookup %t: requested sections %s, want %s", tt.policyLookup, got, tt.want)
+		}
+
+		if comp.OsVersion != "14.4.1" {
+			t.Errorf("policy lookup %t: expected the OS version to be populated, got '%s'", tt.policyLookup, comp.OsVersion)
+		}
+	}
+}
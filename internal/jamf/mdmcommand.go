@@ -0,0 +1,78 @@
+package jamf
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	MdmCommandRestartDevice    = "RESTART_DEVICE"
+	MdmCommandShutDownDevice   = "SHUT_DOWN_DEVICE"
+	MdmCommandDeviceLock       = "DEVICE_LOCK"
+	MdmCommandScheduleOSUpdate = "SCHEDULE_OS_UPDATE"
+)
+
+// MDM command states, as reported by the Jamf Pro MDM commands API
+const (
+	MdmCommandStatePending      = "PENDING"
+	MdmCommandStateAcknowledged = "ACKNOWLEDGED"
+	MdmCommandStateError        = "ERROR"
+	MdmCommandStateNotNow       = "NOT_NOW"
+)
+
+// MdmCommand is an entry in a device's MDM command history
+type MdmCommand struct {
+	Uuid          string `json:"uuid"`
+	CommandType   string `json:"commandType"`
+	CommandState  string `json:"commandState"`
+	DateSent      string `json:"dateSent"`
+	DateCompleted string `json:"dateCompleted"`
+}
+
+// Sent returns the time the command was sent, or the zero time if it cannot be parsed
+func (m MdmCommand) Sent() time.Time {
+	t, _ := time.Parse(time.RFC3339, m.DateSent)
+	return t
+}
+
+type mdmClientData struct {
+	ManagementId string `json:"managementId"`
+}
+
+// MdmCommandBody is the body for the Jamf Pro MDM commands API.
+// CommandData holds the command specific fields, which must include the commandType
+type MdmCommandBody struct {
+	// https://developer.jamf.com/jamf-pro/reference/post_v2-mdm-commands
+	ClientData  []mdmClientData `json:"clientData"`
+	CommandData interface{}     `json:"commandData"`
+}
+
+// newMdmCommandBody returns the JSON body for an MDM command sent to the given management ID
+func newMdmCommandBody(managementId string, commandData interface{}) ([]byte, error) {
+	b := MdmCommandBody{
+		ClientData:  []mdmClientData{{ManagementId: managementId}},
+		CommandData: commandData,
+	}
+
+	return json.Marshal(&b)
+}
+
+// newMdmCommandRequest builds a new http.Request for the Jamf Pro MDM commands API with the given body
+func newMdmCommandRequest(body []byte) (*http.Request, error) {
+	u, err := url.JoinPath(ProAPI, "v2", "mdm", "commands")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+
+	return req, nil
+}
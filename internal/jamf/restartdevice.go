@@ -0,0 +1,79 @@
+package jamf
+
+import (
+	"net/http"
+)
+
+type RestartDeviceCommand struct {
+	computer Computer
+}
+
+type ShutDownDeviceCommand struct {
+	computer Computer
+}
+
+// NewRestartDeviceCommand returns a new RestartDeviceCommand.
+// The computer must have its ManagementId resolved, see Client.ResolveManagementId
+func NewRestartDeviceCommand(comp Computer) RestartDeviceCommand {
+	return RestartDeviceCommand{computer: comp}
+}
+
+// NewShutDownDeviceCommand returns a new ShutDownDeviceCommand.
+// The computer must have its ManagementId resolved, see Client.ResolveManagementId
+func NewShutDownDeviceCommand(comp Computer) ShutDownDeviceCommand {
+	return ShutDownDeviceCommand{computer: comp}
+}
+
+// Body returns the JSON body for the RestartDeviceCommand
+func (c RestartDeviceCommand) Body() ([]byte, error) {
+	return newMdmCommandBody(c.computer.ManagementId, struct {
+		CommandType string `json:"commandType"`
+	}{CommandType: MdmCommandRestartDevice})
+}
+
+// Request builds a new http.Request for the RestartDeviceCommand
+func (c RestartDeviceCommand) Request() (*http.Request, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+
+	return newMdmCommandRequest(body)
+}
+
+// Body returns the JSON body for the ShutDownDeviceCommand
+func (c ShutDownDeviceCommand) Body() ([]byte, error) {
+	return newMdmCommandBody(c.computer.ManagementId, struct {
+		CommandType string `json:"commandType"`
+	}{CommandType: MdmCommandShutDownDevice})
+}
+
+// Request builds a new http.Request for the ShutDownDeviceCommand
+func (c ShutDownDeviceCommand) Request() (*http.Request, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, err
+	}
+
+	return newMdmCommandRequest(body)
+}
+
+// Parameters returns the parameters of the RestartDeviceCommand, which has none
+func (c RestartDeviceCommand) Parameters() map[string]string {
+	return nil
+}
+
+// Parameters returns the parameters of the ShutDownDeviceCommand, which has none
+func (c ShutDownDeviceCommand) Parameters() map[string]string {
+	return nil
+}
+
+// CommandType returns the MDM command type for the RestartDeviceCommand
+func (c RestartDeviceCommand) CommandType() string {
+	return MdmCommandRestartDevice
+}
+
+// CommandType returns the MDM command type for the ShutDownDeviceCommand
+func (c ShutDownDeviceCommand) CommandType() string {
+	return MdmCommandShutDownDevice
+}
@@ -0,0 +1,186 @@
+package jamf
+
+import (
+	"command-on-demand/internal/logger"
+	e "errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRetryAfter is the longest Retry-After which is waited for, longer waits are not retried
+const maxRetryAfter = 30 * time.Second
+
+// ClientOptions configures the timeout, retries, circuit breaker and computer lookup backend of a Client
+type ClientOptions struct {
+	// ComputerLookup is the API used to look up computers, either ComputerLookupPro (the default), which requires
+	// the account to have access to the Jamf Pro API computers inventory, or ComputerLookupClassic
+	ComputerLookup string
+	// Timeout is the timeout of each request to Jamf
+	Timeout time.Duration
+	// MaxRetries is the number of times a failed request is retried, 0 disables retries
+	MaxRetries int
+	// RetryBaseDelay and RetryMaxDelay bound the jittered exponential backoff between retries
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	// BreakerThreshold is the number of consecutive failed requests which opens the circuit breaker, 0 disables it
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit breaker stays open before a trial request is allowed
+	BreakerCooldown time.Duration
+	// Transport sends requests to Jamf, http.DefaultTransport when nil
+	Transport http.RoundTripper
+}
+
+// DefaultClientOptions returns the ClientOptions used when none are configured
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		ComputerLookup:   ComputerLookupPro,
+		Timeout:          10 * time.Second,
+		MaxRetries:       2,
+		RetryBaseDelay:   500 * time.Millisecond,
+		RetryMaxDelay:    5 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// backoff returns the delay before the given retry, using exponential backoff with full jitter
+func (o ClientOptions) backoff(retry int) time.Duration {
+	d := o.RetryBaseDelay << retry
+	if d <= 0 || d > o.RetryMaxDelay {
+		d = o.RetryMaxDelay
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// idempotent returns true if the request can be repeated without side effects beyond those of the first attempt
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut:
+		return true
+	}
+
+	return false
+}
+
+// retryable returns true if the outcome of an attempt should be retried.
+// Idempotent requests are retried after transport errors, 5xx and 429 responses. Other requests, such as command
+// sends, are only retried when Jamf cannot have acted on them: a 429 response or a failure to connect
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		var opErr *net.OpError
+		return idempotent(req) || (e.As(err, &opErr) && opErr.Op == "dial")
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	return idempotent(req) && resp.StatusCode >= 500
+}
+
+// retryAfter returns the delay requested by a Retry-After header, given as seconds or an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+
+	return 0, false
+}
+
+// breaker is a circuit breaker which opens after a number of consecutive failed requests, failing requests fast
+// for the cooldown period. It then allows a single trial request, closing again if the trial request succeeds
+type breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow returns true if a request may be sent
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+
+	b.trial = true
+	logger.Info("Jamf circuit breaker half-open, sending trial request")
+
+	return true
+}
+
+// record records the outcome of a request allowed by allow
+func (b *breaker) record(success bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	wasOpen := b.failures >= b.threshold
+	b.trial = false
+
+	if success {
+		if wasOpen {
+			logger.Info("Jamf circuit breaker closed")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		logger.WithFields(map[string]interface{}{
+			"event":     "jamf_breaker_open",
+			"failures":  b.failures,
+			"openUntil": b.openUntil,
+		}).Error("Jamf circuit breaker open, failing Jamf requests fast")
+	}
+}
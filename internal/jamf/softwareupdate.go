@@ -149,3 +149,21 @@ func (c SoftwareUpdateCommand) Request() (*http.Request, error) {
 
 	return req, nil
 }
+
+// Parameters returns the update configuration of the SoftwareUpdateCommand
+func (c SoftwareUpdateCommand) Parameters() map[string]string {
+	return map[string]string{
+		"targetVersion":           c.config.targetVersion,
+		"skipVersionVerification": strconv.FormatBool(c.config.skipVerify),
+		"updateAction":            c.config.updateAction,
+		"maxDeferrals":            strconv.Itoa(c.config.maxDeferrals),
+		"forceRestart":            strconv.FormatBool(c.config.forceRestart),
+		"applyMajorUpdate":        strconv.FormatBool(c.config.applyMajorUpdate),
+		"priority":                c.config.priority,
+	}
+}
+
+// CommandType returns the MDM command type for the SoftwareUpdateCommand
+func (c SoftwareUpdateCommand) CommandType() string {
+	return MdmCommandScheduleOSUpdate
+}
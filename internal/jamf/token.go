@@ -1,13 +1,34 @@
 package jamf
 
 import (
+	"command-on-demand/internal/errors"
 	"command-on-demand/internal/logger"
+	"sync"
 	"time"
 )
 
+// tokenRetryInterval is how long to wait after a failed renewal before renewing a token which has not yet expired
+const tokenRetryInterval = 10 * time.Second
+
 type Token struct {
 	Value   string `json:"token"`
 	Expires string `json:"expires"`
+
+	// expiresAt is Expires parsed by parseExpiry
+	expiresAt time.Time
+	// refreshMargin is the number of seconds before expiry that the token is renewed, defaultRefreshMargin when 0
+	refreshMargin int
+}
+
+// parseExpiry parses the token's expiry date, returning an error if Jamf returned an expiry which is not RFC3339
+func (t *Token) parseExpiry() error {
+	exp, err := time.Parse(time.RFC3339, t.Expires)
+	if err != nil {
+		return errors.BodyDecodeFailed.Wrap(err)
+	}
+
+	t.expiresAt = exp
+	return nil
 }
 
 // expired returns true if the current token has more than 0 seconds until it expires
@@ -20,27 +41,31 @@ func (t Token) expired() bool {
 	return true
 }
 
-// expiringSoon returns true if the current token has 2 minutes or less until expiry
+// expiringSoon returns true if the current token is within its refresh margin, 2 minutes by default, of expiry
 func (t Token) expiringSoon() bool {
-	if t.timeLeft() < 120 {
+	if t.timeLeft() < t.margin() {
 		return true
 	}
 
 	return false
 }
 
+// margin returns the number of seconds before expiry that the token is renewed
+func (t Token) margin() int {
+	if t.refreshMargin == 0 {
+		return defaultRefreshMargin
+	}
+
+	return t.refreshMargin
+}
+
 // timeLeft returns the number of seconds until the token expires
 func (t Token) timeLeft() int {
-	if t.Expires == "" {
+	if t.expiresAt.IsZero() {
 		return 0
 	}
 
-	exp, err := time.Parse(time.RFC3339, t.Expires)
-	if err != nil {
-		logger.Fatalf("could not parse token expiration date: %s", t.Expires)
-	}
-
-	tls := int(time.Until(exp).Seconds())
+	tls := int(time.Until(t.expiresAt).Seconds())
 
 	if tls < 0 {
 		return 0
@@ -48,3 +73,123 @@ func (t Token) timeLeft() int {
 
 	return tls
 }
+
+// tokenManager holds the client's current token and serialises its renewal, so concurrent requests which find the
+// token expired or expiring soon wait for a single renewal rather than each renewing the token
+type tokenManager struct {
+	sync.Mutex
+	auth       Auth
+	token      *Token
+	retryAfter time.Time
+	// lastErr is the error of the last failed renewal, returned until retryAfter while the token has expired
+	lastErr error
+}
+
+func newTokenManager(auth Auth) *tokenManager {
+	return &tokenManager{
+		auth:  auth,
+		token: &Token{},
+	}
+}
+
+// SetAuth replaces the authentication method of the client, e.g. after its credentials are rotated.
+// The current token is used until it is renewed with the new method
+func (c *Client) SetAuth(auth Auth) {
+	c.tokens.Lock()
+	defer c.tokens.Unlock()
+
+	if c.tokens.auth == auth {
+		return
+	}
+
+	c.tokens.auth = auth
+	c.tokens.retryAfter = time.Time{}
+	logger.Info("Jamf API credentials changed")
+}
+
+// get returns the value of a valid token, renewing the token first if it has expired or is expiring soon.
+// While renewal is failing, requests fail fast with the last error until retryAfter, rather than each waiting on Jamf
+func (m *tokenManager) get(c *Client) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.token.expired() {
+		if time.Now().Before(m.retryAfter) {
+			return "", m.lastErr
+		}
+		return m.renew(c)
+	}
+
+	// a token which is only expiring soon can still be used while renewal is failing
+	if m.token.expiringSoon() && time.Now().After(m.retryAfter) {
+		if _, err := m.renew(c); err != nil {
+			logger.Errorf("could not renew Jamf API token, using current token until it expires: %s", err)
+		}
+	}
+
+	return m.token.Value, nil
+}
+
+// renew replaces the current token with a new token from Jamf and returns its value.
+// The caller must hold the lock
+func (m *tokenManager) renew(c *Client) (string, error) {
+	t, err := m.auth.renewToken(c, m.token)
+	if err == nil {
+		err = t.parseExpiry()
+	}
+
+	if err == nil && t.expired() {
+		err = errors.JamfErrAuthFailed
+		logger.Errorf("Jamf returned an API token which has already expired: %s", t.Expires)
+	}
+
+	if err != nil {
+		m.retryAfter = time.Now().Add(tokenRetryInterval)
+		m.lastErr = err
+		return "", err
+	}
+
+	// token lifetimes are configurable in Jamf and may be shorter than the default refresh margin,
+	// which would otherwise cause a new token to be claimed for every request
+	if left := t.timeLeft(); t.margin() >= left {
+		t.refreshMargin = left / 4
+		if t.refreshMargin < 1 {
+			t.refreshMargin = 1
+		}
+	}
+
+	m.token = t
+	logger.Debug("successfully acquired new Jamf API token")
+
+	return m.token.Value, nil
+}
+
+// untilRefresh returns the time until the current token should be renewed, allowing for a failed renewal
+func (m *tokenManager) untilRefresh() time.Duration {
+	m.Lock()
+	defer m.Unlock()
+
+	wait := time.Duration(m.token.timeLeft()-m.token.margin()) * time.Second
+	if retry := time.Until(m.retryAfter); retry > wait {
+		wait = retry
+	}
+
+	return wait
+}
+
+// RefreshToken is a goroutine that renews the Jamf API token as it nears expiry, so requests rarely wait for a renewal.
+// Failed renewals are logged and retried after tokenRetryInterval; requests still renew the token themselves if it
+// expires in the meantime
+func (c *Client) RefreshToken() {
+	for {
+		wait := c.tokens.untilRefresh()
+		if wait < time.Second {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+
+		if _, err := c.tokens.get(c); err != nil {
+			logger.Errorf("background Jamf API token renewal failed: %s", err)
+		}
+	}
+}
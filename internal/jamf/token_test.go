@@ -0,0 +1,118 @@
+package jamf
+
+import (
+	"command-on-demand/internal/errors"
+	"encoding/json"
+	e "errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeOAuth is a Jamf OAuth token endpoint issuing tokens with the given lifetime, or failing with the given status,
+// and counting token requests
+type fakeOAuth struct {
+	expiresIn atomic.Int32
+	status    atomic.Int32
+	requests  atomic.Int32
+}
+
+func (f *fakeOAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/"+ProAPI+endpointOAuthToken {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	f.requests.Add(1)
+	if status := int(f.status.Load()); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	json.NewEncoder(w).Encode(oauthToken{AccessToken: "token", ExpiresIn: int(f.expiresIn.Load())})
+}
+
+// newTestOAuthClient returns a Client authenticating with client credentials at the given fake token endpoint
+func newTestOAuthClient(t *testing.T, f *fakeOAuth) (*Client, error) {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(f)
+	t.Cleanup(srv.Close)
+
+	opts := testClientOptions()
+	opts.Transport = srv.Client().Transport
+
+	return NewClient(strings.TrimPrefix(srv.URL, "https://"), ClientCredentials{ClientId: "id", ClientSecret: "secret"}, opts)
+}
+
+func TestTokenRequestFailure(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusInternalServerError} {
+		f := &fakeOAuth{}
+		f.status.Store(int32(status))
+
+		_, err := newTestOAuthClient(t, f)
+
+		var jErr errors.Jamf
+		if !e.As(err, &jErr) || jErr.Status != http.StatusBadGateway {
+			t.Errorf("Jamf token status %d: expected a 502 error, got %v", status, err)
+		}
+	}
+}
+
+func TestTokenRenewalFailsFast(t *testing.T) {
+	f := &fakeOAuth{}
+	f.expiresIn.Store(3600)
+
+	c, err := newTestOAuthClient(t, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the token expires while Jamf is failing, so each request would otherwise renew it
+	c.tokens.token = &Token{}
+	f.status.Store(http.StatusServiceUnavailable)
+
+	for i := 0; i < 3; i++ {
+		if err = send(t, c, http.MethodGet); !e.Is(err, errors.JamfErrAuthFailed) {
+			t.Errorf("expected the token renewal error, got %v", err)
+		}
+	}
+
+	if n := f.requests.Load(); n != 2 {
+		t.Errorf("expected a single renewal after the initial token, got %d token requests", n)
+	}
+}
+
+func TestTokenShortLifetime(t *testing.T) {
+	f := &fakeOAuth{}
+	f.expiresIn.Store(60)
+
+	c, err := newTestOAuthClient(t, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = send(t, c, http.MethodGet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := f.requests.Load(); n != 1 {
+		t.Errorf("expected a token shorter than the refresh margin to be reused, got %d token requests", n)
+	}
+
+	if c.tokens.token.expiringSoon() {
+		t.Errorf("expected the refresh margin to be shortened, got %d seconds", c.tokens.token.margin())
+	}
+}
+
+func TestTokenAlreadyExpired(t *testing.T) {
+	f := &fakeOAuth{}
+
+	if _, err := newTestOAuthClient(t, f); !e.Is(err, errors.JamfErrAuthFailed) {
+		t.Errorf("expected a token without a lifetime to be rejected, got %v", err)
+	}
+}
@@ -18,6 +18,24 @@ func Setup() {
 	log.SetLevel(level)
 }
 
+// SetLevel sets the logging level, leaving it unchanged if the level is empty or not recognised
+func SetLevel(l string) {
+	if l == "" {
+		return
+	}
+
+	level, err := logrus.ParseLevel(l)
+	if err != nil {
+		log.Errorf("invalid log level: %s", l)
+		return
+	}
+
+	if level != log.GetLevel() {
+		log.Infof("log level set to %s", level)
+		log.SetLevel(level)
+	}
+}
+
 func Info(args ...interface{}) {
 	log.Info(args...)
 }
@@ -26,6 +44,14 @@ func Infof(format string, args ...interface{}) {
 	log.Infof(format, args...)
 }
 
+func Warn(args ...interface{}) {
+	log.Warn(args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	log.Warnf(format, args...)
+}
+
 func Error(args ...interface{}) {
 	log.Error(args...)
 }
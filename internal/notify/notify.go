@@ -0,0 +1,384 @@
+package notify
+
+import (
+	"bytes"
+	"command-on-demand/internal/logger"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types sent to webhook targets
+const (
+	EventCodeIssued       = "code.issued"
+	EventCodeMismatch     = "code.mismatch"
+	EventCommandSent      = "command.sent"
+	EventCommandFailed    = "command.failed"
+	EventLockoutTriggered = "lockout.triggered"
+	EventBudgetTripped    = "budget.tripped"
+)
+
+// Headers set on each delivery. The signature is the hex encoded HMAC-SHA256 of the timestamp, a full stop and the body,
+// keyed with the target's secret, so receivers can check both the payload and its age
+const (
+	HeaderEvent     = "X-Cmdod-Event"
+	HeaderDelivery  = "X-Cmdod-Delivery"
+	HeaderTimestamp = "X-Cmdod-Timestamp"
+	HeaderSignature = "X-Cmdod-Signature"
+)
+
+// validEvents are the event types targets can subscribe to
+var validEvents = map[string]bool{
+	EventCodeIssued:       true,
+	EventCodeMismatch:     true,
+	EventCommandSent:      true,
+	EventCommandFailed:    true,
+	EventLockoutTriggered: true,
+	EventBudgetTripped:    true,
+}
+
+// Event is the JSON payload sent to webhook targets
+type Event struct {
+	Id     string                 `json:"id"`
+	Type   string                 `json:"type"`
+	Time   time.Time              `json:"time"`
+	Tenant string                 `json:"tenant,omitempty"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+// Target is a webhook endpoint which events are sent to.
+// Events lists the event types sent to the target, or is empty for every event type
+type Target struct {
+	Name   string   `json:"name" yaml:"name"`
+	URL    string   `json:"url" yaml:"url"`
+	Secret string   `json:"secret" yaml:"secret"`
+	Events []string `json:"events,omitempty" yaml:"events"`
+}
+
+// ParseTargets decodes a JSON list of targets, returning an error if a target is invalid or names are not unique
+func ParseTargets(data []byte) ([]Target, error) {
+	var targets []Target
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, t := range targets {
+		if err := t.validate(); err != nil {
+			return nil, err
+		}
+
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate webhook target name: %s", t.Name)
+		}
+		names[t.Name] = true
+	}
+
+	return targets, nil
+}
+
+// validate returns an error if the target is missing a field or has an unknown event type
+func (t Target) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("webhook target must have a name")
+	}
+
+	u, err := url.Parse(t.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("webhook target %s must have an http or https url", t.Name)
+	}
+
+	if t.Secret == "" {
+		return fmt.Errorf("webhook target %s must have a secret", t.Name)
+	}
+
+	for _, e := range t.Events {
+		if !validEvents[e] {
+			return fmt.Errorf("webhook target %s has unknown event type %s", t.Name, e)
+		}
+	}
+
+	return nil
+}
+
+// wants returns true if the target subscribes to the event type
+func (t Target) wants(eventType string) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+
+	for _, e := range t.Events {
+		if e == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Options configures the delivery queue, retries and dead-letter log of a Dispatcher
+type Options struct {
+	// QueueSize is the number of deliveries which can wait to be sent, further events are dead-lettered
+	QueueSize int
+	// Workers is the number of deliveries sent concurrently
+	Workers int
+	// MaxAttempts is the number of times a delivery is attempted before it is dead-lettered
+	MaxAttempts int
+	// RetryBaseDelay and RetryMaxDelay bound the jittered exponential backoff between attempts
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	// Timeout is the timeout of each attempt
+	Timeout time.Duration
+	// DeadLetterPath is a file which undeliverable events are appended to, as well as being logged
+	DeadLetterPath string
+}
+
+// DefaultOptions returns the Options used when none are configured
+func DefaultOptions() Options {
+	return Options{
+		QueueSize:      1000,
+		Workers:        4,
+		MaxAttempts:    5,
+		RetryBaseDelay: time.Second,
+		RetryMaxDelay:  time.Minute,
+		Timeout:        10 * time.Second,
+	}
+}
+
+// delivery is an event to be sent to a single target
+type delivery struct {
+	target   Target
+	event    Event
+	body     []byte
+	attempts int
+}
+
+// Dispatcher sends events to webhook targets in the background. Send never blocks: events are queued, and
+// deliveries which cannot be queued or fail every attempt are written to the dead-letter log.
+// A nil Dispatcher discards events, so callers need not check whether webhooks are configured
+type Dispatcher struct {
+	sync.Mutex
+	tenant  string
+	targets []Target
+	opts    Options
+	queue   chan *delivery
+	client  *http.Client
+}
+
+// NewDispatcher returns a Dispatcher for the given tenant's targets, see ParseTargets, which must be started with Run.
+// The tenant is set on every event sent
+func NewDispatcher(tenant string, targets []Target, opts Options) (*Dispatcher, error) {
+	if opts.QueueSize <= 0 || opts.Workers <= 0 || opts.MaxAttempts <= 0 {
+		return nil, fmt.Errorf("webhook queue size, workers and attempts must be greater than 0")
+	}
+
+	return &Dispatcher{
+		tenant:  tenant,
+		targets: targets,
+		opts:    opts,
+		queue:   make(chan *delivery, opts.QueueSize),
+		client:  &http.Client{Timeout: opts.Timeout},
+	}, nil
+}
+
+// SetTargets replaces the Dispatcher's targets, e.g. when the configuration is reloaded.
+// Deliveries already queued are sent to the targets they were queued for
+func (d *Dispatcher) SetTargets(targets []Target) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.targets = targets
+}
+
+// Run is a goroutine which sends queued deliveries, with Options.Workers deliveries in flight at once
+func (d *Dispatcher) Run() {
+	if d == nil {
+		return
+	}
+
+	for i := 1; i < d.opts.Workers; i++ {
+		go d.work()
+	}
+	d.work()
+}
+
+// work sends queued deliveries one at a time
+func (d *Dispatcher) work() {
+	for dl := range d.queue {
+		d.deliver(dl)
+	}
+}
+
+// Send queues an event of the given type for every target subscribed to it
+func (d *Dispatcher) Send(eventType string, data map[string]interface{}) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	targets := d.targets
+	d.Unlock()
+
+	e := Event{
+		Id:     uuid.NewString(),
+		Type:   eventType,
+		Time:   time.Now().UTC(),
+		Tenant: d.tenant,
+		Data:   data,
+	}
+
+	var body []byte
+	for _, t := range targets {
+		if !t.wants(eventType) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(e); err != nil {
+				logger.Error("could not encode webhook event: ", err)
+				return
+			}
+		}
+
+		d.enqueue(&delivery{target: t, event: e, body: body})
+	}
+}
+
+// enqueue queues the delivery without blocking, dead-lettering it if the queue is full
+func (d *Dispatcher) enqueue(dl *delivery) {
+	select {
+	case d.queue <- dl:
+	default:
+		d.deadLetter(dl, fmt.Errorf("queue full"))
+	}
+}
+
+// deliver makes one attempt to send the delivery, scheduling a retry with backoff if it fails and can be retried
+func (d *Dispatcher) deliver(dl *delivery) {
+	dl.attempts++
+
+	retry, err := d.send(dl)
+	if err == nil {
+		logger.Debugf("webhook %s delivered to %s", dl.event.Id, dl.target.Name)
+		return
+	}
+
+	if !retry || dl.attempts >= d.opts.MaxAttempts {
+		d.deadLetter(dl, err)
+		return
+	}
+
+	delay := d.backoff(dl.attempts)
+	logger.Debugf("webhook %s to %s failed, retrying in %s: %s", dl.event.Id, dl.target.Name, delay, err)
+	time.AfterFunc(delay, func() { d.enqueue(dl) })
+}
+
+// send posts the delivery's signed body to its target, returning whether a failure can be retried
+func (d *Dispatcher) send(dl *delivery) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, dl.target.URL, bytes.NewReader(dl.body))
+	if err != nil {
+		return false, err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, dl.event.Type)
+	req.Header.Set(HeaderDelivery, dl.event.Id)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(dl.target.Secret, ts, dl.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	// other client errors will not succeed on retry
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout
+
+	return retry, fmt.Errorf("webhook target responded with status %d", resp.StatusCode)
+}
+
+// backoff returns the delay before the attempt after the given attempt, using exponential backoff with full jitter
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.opts.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > d.opts.RetryMaxDelay {
+		delay = d.opts.RetryMaxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// deadLetter records an undeliverable delivery in the log and, when configured, the dead-letter file
+func (d *Dispatcher) deadLetter(dl *delivery, reason error) {
+	logger.WithFields(map[string]interface{}{
+		"event":     "webhook_dead_letter",
+		"tenant":    d.tenant,
+		"target":    dl.target.Name,
+		"eventType": dl.event.Type,
+		"eventId":   dl.event.Id,
+		"attempts":  dl.attempts,
+	}).Error("webhook could not be delivered: ", reason)
+
+	if d.opts.DeadLetterPath == "" {
+		return
+	}
+
+	line, err := json.Marshal(struct {
+		Time     time.Time       `json:"time"`
+		Target   string          `json:"target"`
+		Attempts int             `json:"attempts"`
+		Error    string          `json:"error"`
+		Event    json.RawMessage `json:"event"`
+	}{time.Now().UTC(), dl.target.Name, dl.attempts, reason.Error(), dl.body})
+	if err != nil {
+		logger.Error("could not encode dead-lettered webhook: ", err)
+		return
+	}
+
+	f, err := os.OpenFile(d.opts.DeadLetterPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Error("could not open webhook dead-letter log: ", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		logger.Error("could not write webhook dead-letter log: ", err)
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a delivery, see HeaderSignature
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"command-on-demand/internal/audit"
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/jamf"
+	"command-on-demand/internal/logger"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// webhookSource identifies commands completed by a Jamf webhook in audit entries.
+// Their token is the name of the client token which requested the code, see Code
+const webhookSource = "jamf-webhook"
+
+// auditRecord holds the details of a command request which are recorded in each of its audit entries
+type auditRecord struct {
+	requestId string
+	token     string
+	source    string
+	command   string
+	udid      string
+}
+
+// newAuditRecord returns the auditRecord for a client request to send the named command
+func newAuditRecord(r *http.Request, command string, udid string) auditRecord {
+	rec := auditRecord{requestId: getRequestId(r), command: command, udid: udid}
+	if t := getClientToken(r); t != nil {
+		rec.token = t.Name
+	}
+
+	return rec
+}
+
+// auditEntry returns an audit.Entry for the record, the computer, if it has been looked up, and the outcome
+func (s Server) auditEntry(rec auditRecord, event string, comp jamf.Computer, outcome string, err error) audit.Entry {
+	e := audit.Entry{
+		Tenant:     s.tenant,
+		RequestId:  rec.requestId,
+		Token:      rec.token,
+		Source:     rec.source,
+		Event:      event,
+		Command:    rec.command,
+		Udid:       rec.udid,
+		Serial:     comp.SerialNumber,
+		ComputerId: comp.Id,
+		Outcome:    outcome,
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	return e
+}
+
+// auditValidation records the outcome of validating a command request.
+// An error is returned if the entry could not be written, and the command must then not be sent,
+// so every command sent has a record of the validation which allowed it
+func (s Server) auditValidation(rec auditRecord, comp jamf.Computer, vErr error) error {
+	outcome := audit.OutcomeAccepted
+	if vErr != nil {
+		outcome = audit.OutcomeRejected
+	}
+
+	if err := s.writeAudit(s.auditEntry(rec, audit.EventValidation, comp, outcome, vErr)); err != nil {
+		return errors.AuditWriteFailed.Wrap(err)
+	}
+
+	return nil
+}
+
+// auditCommand records the result of building and sending a command. cmd is nil if the command was not built
+func (s Server) auditCommand(rec auditRecord, comp jamf.Computer, cmd jamf.Commander, sErr error) {
+	outcome := audit.OutcomeSent
+	if sErr != nil {
+		outcome = audit.OutcomeFailed
+	}
+
+	e := s.auditEntry(rec, audit.EventCommand, comp, outcome, sErr)
+	if cmd != nil {
+		e.Params = cmd.Parameters()
+	}
+
+	s.writeAudit(e)
+}
+
+// writeAudit writes the entry to the audit log, if one is configured. Failures are logged as security events
+func (s Server) writeAudit(e audit.Entry) error {
+	if s.auditLog == nil {
+		return nil
+	}
+
+	err := s.auditLog.Write(e)
+	if err != nil {
+		logger.WithFields(map[string]interface{}{
+			"event":     "audit_write_failed",
+			"security":  true,
+			"tenant":    s.tenant,
+			"requestId": e.RequestId,
+			"command":   e.Command,
+			"udid":      e.Udid,
+			"outcome":   e.Outcome,
+		}).Error("could not write audit log entry: ", err)
+	}
+
+	return err
+}
+
+// auditLogPath returns the path of the named tenant's audit log: the configured path with the tenant name inserted
+// before its extension, e.g. /data/cmdod-audit-acme.jsonl, so each tenant has its own hash chain
+func auditLogPath(path string, tenant string) string {
+	if tenant == "" {
+		return path
+	}
+
+	ext := filepath.Ext(path)
+
+	return strings.TrimSuffix(path, ext) + "-" + tenant + ext
+}
+
+// openAuditLog opens the audit log configured in the given Environment for the named tenant, or returns nil if none
+// is configured. The log is keyed with EnvAuditHMACKey, which is required
+func openAuditLog(env Environment, tenant string) (*audit.Log, error) {
+	path := env[EnvAuditLogPath]
+	if path == "" {
+		return nil, nil
+	}
+
+	key := []byte(env[EnvAuditHMACKey])
+	if len(key) < audit.MinKeyBytes {
+		return nil, fmt.Errorf("%s requires %s to be set to a key of at least %d bytes",
+			EnvAuditLogPath, EnvAuditHMACKey, audit.MinKeyBytes)
+	}
+
+	path = auditLogPath(path, tenant)
+	l, err := audit.Open(path, key)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("writing audit log to ", path)
+
+	return l, nil
+}
+
+// AuditKey returns the audit log HMAC key of the named tenant, or of the single tenant when tenant is empty, so audit
+// logs can be verified offline. The key is resolved as when the service starts: from the config file at EnvConfigFile
+// and the environment, including tenant overrides such as CMDOD_T_ACME_AUDIT_HMAC_KEY and _FILE variants
+func AuditKey(tenant string) ([]byte, error) {
+	t := &Tenants{configFile: os.Getenv(envNamespace + EnvConfigFile)}
+
+	envs, err := t.environments()
+	if err != nil {
+		return nil, err
+	}
+
+	env, ok := envs[tenant]
+	if !ok {
+		if tenant == "" {
+			return nil, fmt.Errorf("tenants are configured, the tenant of the audit log must be given")
+		}
+		return nil, fmt.Errorf("unknown tenant: %s", tenant)
+	}
+
+	return []byte(env[EnvAuditHMACKey]), nil
+}
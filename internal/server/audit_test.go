@@ -0,0 +1,125 @@
+package server
+
+import (
+	"command-on-demand/internal/audit"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAuditLogPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		tenant string
+		want   string
+	}{
+		{path: "/data/cmdod-audit.jsonl", tenant: "", want: "/data/cmdod-audit.jsonl"},
+		{path: "/data/cmdod-audit.jsonl", tenant: "acme", want: "/data/cmdod-audit-acme.jsonl"},
+		{path: "/data/audit", tenant: "acme", want: "/data/audit-acme"},
+	}
+
+	for _, tt := range tests {
+		if got := auditLogPath(tt.path, tt.tenant); got != tt.want {
+			t.Errorf("auditLogPath(%s, %s) = %s, want %s", tt.path, tt.tenant, got, tt.want)
+		}
+	}
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	if _, err := openAuditLog(Environment{EnvAuditLogPath: path}, ""); err == nil ||
+		!strings.Contains(err.Error(), EnvAuditHMACKey) {
+		t.Errorf("expected an error requiring %s, got %v", EnvAuditHMACKey, err)
+	}
+
+	env := Environment{EnvAuditLogPath: path, EnvAuditHMACKey: strings.Repeat("k", 32)}
+	for _, tenant := range []string{"acme", "globex"} {
+		l, err := openAuditLog(env, tenant)
+		if err != nil {
+			t.Fatalf("tenant %s: %s", tenant, err)
+		}
+		defer l.Close()
+	}
+
+	if l, err := openAuditLog(Environment{}, ""); l != nil || err != nil {
+		t.Errorf("expected no audit log without %s, got %v, %v", EnvAuditLogPath, l, err)
+	}
+}
+
+func TestAuditKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "acme-key")
+	if err := os.WriteFile(keyFile, []byte("acme-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfigFile(t, `
+jamf_fqdn: yourorg.jamfcloud.com
+jamf_api_user: user
+jamf_api_password: password
+code_proof_ea_name: cmdod-code
+audit_hmac_key: base-key
+tenants:
+  acme:
+    audit_hmac_key_file: `+keyFile+`
+  globex:
+    jamf_fqdn: globex.jamfcloud.com
+`)
+	t.Setenv(envNamespace+EnvConfigFile, path)
+	t.Setenv(tenantNamespace("globex")+EnvAuditHMACKey, "globex-key")
+
+	for tenant, want := range map[string]string{"acme": "acme-key", "globex": "globex-key"} {
+		key, err := AuditKey(tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(key) != want {
+			t.Errorf("tenant %s: got key '%s', want '%s'", tenant, key, want)
+		}
+	}
+
+	for _, tenant := range []string{"", "initech"} {
+		if _, err := AuditKey(tenant); err == nil {
+			t.Errorf("tenant '%s': expected an error", tenant)
+		}
+	}
+}
+
+func TestSendCommandAuditsRejections(t *testing.T) {
+	s, path := newTestWebhookServer(t, &fakeJamf{})
+	token := s.cfg().tokens.byName("helpdesk")
+
+	tests := []struct {
+		udid    string
+		command string
+		want    string
+	}{
+		{udid: "not-a-udid", command: CommandRestartDevice, want: "UDID invalid"},
+		{udid: testUdid, command: CommandShutDownDevice, want: "command not enabled"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r = withClientToken(mux.SetURLVars(r, map[string]string{"udid": tt.udid}), token)
+		s.sendCommand(httptest.NewRecorder(), r, tt.command, nil)
+	}
+
+	entries := readAuditEntries(t, path)
+	if len(entries) != len(tests) {
+		t.Fatalf("expected a validation entry for each rejected request, got %+v", entries)
+	}
+
+	for i, tt := range tests {
+		e := entries[i]
+		if e.Outcome != audit.OutcomeRejected || e.Token != "helpdesk" || e.Command != tt.command || e.Error != tt.want {
+			t.Errorf("expected a rejected %s by helpdesk with error '%s', got %+v", tt.command, tt.want, e)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/logger"
+	"encoding/json"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const codesBucket = "codes"
+
+// boltDBs holds the bbolt databases opened by openBoltBucket, so tenants configured with the same path share
+// one database with a bucket each. bbolt locks the file, so a second Open of the same path would time out
+var boltDBs = struct {
+	sync.Mutex
+	open map[string]*bolt.DB
+}{open: make(map[string]*bolt.DB)}
+
+// storedCode is the serialised form of a Code in the BoltCodeStore
+type storedCode struct {
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+	Command string    `json:"command,omitempty"`
+	Token   string    `json:"token,omitempty"`
+}
+
+// BoltCodeStore stores Code objects in an embedded bbolt database file, so outstanding codes survive restarts.
+// bbolt serialises write transactions, so no additional locking is required
+type BoltCodeStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// NewBoltCodeStore opens, or creates, the bbolt database at the given path.
+// Codes are stored in a bucket for the given namespace, so several tenants can share a database
+func NewBoltCodeStore(path string, namespace string) (*BoltCodeStore, error) {
+	db, bucket, err := openBoltBucket(path, codesBucket, namespace)
+	if err != nil {
+		return nil, errors.CodeStoreFailed.Wrap(err)
+	}
+
+	logger.Infof("using on-disk code store at %s (bucket %s)", path, bucket)
+
+	return &BoltCodeStore{db: db, bucket: bucket}, nil
+}
+
+// openBoltBucket opens, or creates, the bbolt database at the given path, unless it is already open,
+// and creates the named bucket for the given namespace within it
+func openBoltBucket(path string, name string, namespace string) (*bolt.DB, []byte, error) {
+	boltDBs.Lock()
+	defer boltDBs.Unlock()
+
+	db, ok := boltDBs.open[path]
+	if !ok {
+		var err error
+		db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, nil, err
+		}
+		boltDBs.open[path] = db
+	}
+
+	bucket := []byte(name)
+	if namespace != "" {
+		bucket = []byte(name + ":" + namespace)
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return db, bucket, nil
+}
+
+// NewCode generates a new Code object, see newCode.
+// The Code object is associated with the given UDID and stored in the BoltCodeStore.
+// Returns the newly created Code object and any errors encountered during the process.
+func (c *BoltCodeStore) NewCode(udid string, command string, token string) (*Code, error) {
+	code, err := newCode(command, token)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := json.Marshal(storedCode{Value: code.value, Expires: code.expires, Command: code.command, Token: code.token})
+	if err != nil {
+		return nil, errors.CodeStoreFailed.Wrap(err)
+	}
+
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.bucket).Put([]byte(udid), v)
+	})
+	if err != nil {
+		return nil, errors.CodeStoreFailed.Wrap(err)
+	}
+
+	logger.Debugf("generated new code for %s. Expiry: %s", udid, code.expires)
+
+	return code, nil
+}
+
+// ExpireCode will force the expiry of a code for the given UDID
+func (c *BoltCodeStore) ExpireCode(udid string) {
+	logger.Debugf("forcing expiry of code for %s", udid)
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.bucket).Delete([]byte(udid))
+	})
+	if err != nil {
+		logger.Errorf("could not expire code for %s: %s", udid, err)
+	}
+}
+
+// ListCodes returns the CodeInfo of every unexpired Code in the BoltCodeStore, ordered by expiry
+func (c *BoltCodeStore) ListCodes() ([]CodeInfo, error) {
+	codes := make([]CodeInfo, 0)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.bucket).ForEach(func(k, v []byte) error {
+			code, err := decodeStoredCode(v)
+			if err != nil {
+				return err
+			}
+			if !code.isExpired() {
+				codes = append(codes, code.info(string(k)))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.CodeStoreFailed.Wrap(err)
+	}
+	sortCodeInfo(codes)
+
+	return codes, nil
+}
+
+// RevokeCode removes the unexpired Code for the given UDID
+func (c *BoltCodeStore) RevokeCode(udid string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		v := b.Get([]byte(udid))
+		if v == nil {
+			return errors.CodeNotFound
+		}
+
+		code, err := decodeStoredCode(v)
+		if err == nil && code.isExpired() {
+			err = errors.CodeNotFound
+		}
+
+		if delErr := b.Delete([]byte(udid)); delErr != nil {
+			return errors.CodeStoreFailed.Wrap(delErr)
+		}
+		return err
+	})
+}
+
+// FlushCodes removes every Code from the BoltCodeStore
+func (c *BoltCodeStore) FlushCodes() (n int, err error) {
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(c.bucket).Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			if err := cur.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.CodeStoreFailed.Wrap(err)
+	}
+
+	return n, nil
+}
+
+// Prune is a goroutine that runs every given interval and removes expired codes from the BoltCodeStore
+func (c *BoltCodeStore) Prune(every time.Duration) {
+	for range time.Tick(every) {
+		logger.Debug("pruning expired codes")
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(c.bucket)
+			cur := b.Cursor()
+			for k, v := cur.First(); k != nil; k, v = cur.Next() {
+				code, err := decodeStoredCode(v)
+				if err == nil && !code.isExpired() {
+					continue
+				}
+
+				// deleting via the cursor keeps its position valid
+				if err = cur.Delete(); err != nil {
+					return err
+				}
+				logger.Debugf("pruned expired code for %s", k)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error("could not prune expired codes: ", err)
+		}
+	}
+}
+
+// getCode returns the Code object for the given UDID if it exists and is not expired.
+func (c *BoltCodeStore) getCode(udid string) (code *Code, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(c.bucket).Get([]byte(udid))
+		if v == nil {
+			return errors.CodeNotFound
+		}
+
+		code, err = decodeStoredCode(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if code.isExpired() {
+		logger.Debugf("code for %s expired at: %s", udid, code.expires)
+		return nil, errors.CodeExpired
+	}
+
+	return code, nil
+}
+
+// consumeCode atomically returns and removes the Code object for the given UDID if it exists and is not expired.
+func (c *BoltCodeStore) consumeCode(udid string) (code *Code, err error) {
+	logger.Debugf("consuming code for %s", udid)
+
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		v := b.Get([]byte(udid))
+		if v == nil {
+			return errors.CodeNotFound
+		}
+
+		// decode before deleting, as v is only valid for the life of the transaction and not after modification
+		code, err = decodeStoredCode(v)
+		if delErr := b.Delete([]byte(udid)); delErr != nil {
+			return errors.CodeStoreFailed.Wrap(delErr)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if code.isExpired() {
+		logger.Debugf("code for %s expired at: %s", udid, code.expires)
+		return nil, errors.CodeExpired
+	}
+
+	return code, nil
+}
+
+// consumeCodeValue atomically returns and removes the Code object for the given UDID if it has the given value
+// and is not expired. errors.CodeNotFound is returned if the UDID has no Code, or a Code with a different value.
+func (c *BoltCodeStore) consumeCodeValue(udid string, value string) (code *Code, err error) {
+	logger.Debugf("consuming code for %s", udid)
+
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		v := b.Get([]byte(udid))
+		if v == nil {
+			return errors.CodeNotFound
+		}
+
+		if code, err = decodeStoredCode(v); err != nil {
+			return err
+		}
+
+		if code.value != value {
+			return errors.CodeNotFound
+		}
+
+		if err = b.Delete([]byte(udid)); err != nil {
+			return errors.CodeStoreFailed.Wrap(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if code.isExpired() {
+		logger.Debugf("code for %s expired at: %s", udid, code.expires)
+		return nil, errors.CodeExpired
+	}
+
+	return code, nil
+}
+
+// decodeStoredCode returns the Code for a value from the codes bucket
+func decodeStoredCode(v []byte) (*Code, error) {
+	var sc storedCode
+	if err := json.Unmarshal(v, &sc); err != nil {
+		return nil, errors.CodeStoreFailed.Wrap(err)
+	}
+
+	return &Code{value: sc.Value, expires: sc.Expires, command: sc.Command, token: sc.Token}, nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/logger"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const stateBucket = "state"
+
+// storedState is the serialised form of a value in the BoltStateStore
+type storedState struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// BoltStateStore stores state in the bbolt database file of the BoltCodeStore, so it survives restarts.
+// bbolt serialises write transactions, so no additional locking is required
+type BoltStateStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// NewBoltStateStore opens, or creates, the bbolt database at the given path.
+// State is stored in a bucket for the given namespace, so several tenants can share a database
+func NewBoltStateStore(path string, namespace string) (*BoltStateStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%s code store requires %s to be set", CodeStoreBolt, EnvCodeStorePath)
+	}
+
+	db, bucket, err := openBoltBucket(path, stateBucket, namespace)
+	if err != nil {
+		return nil, errors.StateStoreFailed.Wrap(err)
+	}
+
+	return &BoltStateStore{db: db, bucket: bucket}, nil
+}
+
+// get returns the value of the given key, or nil if it is not set or has expired
+func (b *BoltStateStore) get(key string) (v []byte, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		v, err = decodeStoredState(tx.Bucket(b.bucket).Get([]byte(key)))
+		return err
+	})
+	if err != nil {
+		return nil, errors.StateStoreFailed.Wrap(err)
+	}
+
+	return v, nil
+}
+
+// update atomically replaces the value of the given key with the value returned by fn, see StateStore
+func (b *BoltStateStore) update(key string, ttl time.Duration, fn func(v []byte) ([]byte, error)) error {
+	var fnErr error
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.bucket)
+		v, err := decodeStoredState(bk.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+
+		if v, fnErr = fn(v); fnErr != nil {
+			return fnErr
+		}
+
+		if v == nil {
+			return bk.Delete([]byte(key))
+		}
+
+		s, err := json.Marshal(storedState{Value: v, Expires: stateExpiry(ttl)})
+		if err != nil {
+			return err
+		}
+
+		return bk.Put([]byte(key), s)
+	})
+
+	if fnErr != nil {
+		return fnErr
+	}
+
+	if err != nil {
+		return errors.StateStoreFailed.Wrap(err)
+	}
+
+	return nil
+}
+
+// Prune is a goroutine that runs every given interval and removes expired state from the BoltStateStore
+func (b *BoltStateStore) Prune(every time.Duration) {
+	for range time.Tick(every) {
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			cur := tx.Bucket(b.bucket).Cursor()
+			for k, v := cur.First(); k != nil; k, v = cur.Next() {
+				if s, err := decodeStoredState(v); err == nil && s != nil {
+					continue
+				}
+
+				// deleting via the cursor keeps its position valid
+				if err := cur.Delete(); err != nil {
+					return err
+				}
+				logger.Debugf("pruned expired state %s", k)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error("could not prune expired state: ", err)
+		}
+	}
+}
+
+// decodeStoredState returns the value for a value from the state bucket, or nil if there is none or it has expired
+func decodeStoredState(v []byte) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	var s storedState
+	if err := json.Unmarshal(v, &s); err != nil {
+		return nil, err
+	}
+
+	if stateExpired(s.Expires) {
+		return nil, nil
+	}
+
+	return s.Value, nil
+}
@@ -4,41 +4,121 @@ import (
 	"command-on-demand/internal/errors"
 	"command-on-demand/internal/logger"
 	"command-on-demand/internal/util"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
-// Code contains the random value and expiry time
+const (
+	CodeStoreMemory = "memory"
+	CodeStoreBolt   = "bolt"
+	CodeStoreRedis  = "redis"
+
+	codeLifetime = 2 * time.Minute
+)
+
+// Code contains the random value and expiry time, and the command to send once the code is proven, if any,
+// with the name of the client token which requested it, so the command is attributed to that client
 type Code struct {
 	value   string
 	expires time.Time
+	command string
+	token   string
 }
 
-// CodeStore stores Code objects and provides a mutex for safe concurrent access
-type CodeStore struct {
-	sync.RWMutex
-	codes map[string]Code
+// CodeInfo describes an outstanding Code without revealing its value
+type CodeInfo struct {
+	Udid    string    `json:"udid"`
+	Expires time.Time `json:"expires"`
+	Command string    `json:"command,omitempty"`
+	Token   string    `json:"token,omitempty"`
 }
 
-// NewCodeStore creates a new instance of CodeStore with an empty map of codes
-func NewCodeStore() *CodeStore {
-	return &CodeStore{
-		codes: make(map[string]Code),
+// CodeStore is the interface for all code storage backends
+// NewCode generates and stores a new Code for a UDID, requested with the named client token, replacing any existing Code
+// ExpireCode forces the expiry of the Code for a UDID
+// ListCodes returns the CodeInfo of every unexpired Code, ordered by expiry
+// RevokeCode removes the Code for a UDID, returning errors.CodeNotFound if there is no unexpired Code
+// FlushCodes removes every Code and returns the number removed
+// Prune is a goroutine which periodically removes expired codes, if the backend requires it
+// getCode returns the Code for a UDID if it exists and is not expired
+// consumeCode atomically returns and removes the Code for a UDID, so a Code can only be consumed once
+// consumeCodeValue is consumeCode for a Code with the given value only, so a Code issued since value was read is kept
+type CodeStore interface {
+	NewCode(udid string, command string, token string) (*Code, error)
+	ExpireCode(udid string)
+	ListCodes() ([]CodeInfo, error)
+	RevokeCode(udid string) error
+	FlushCodes() (int, error)
+	Prune(every time.Duration)
+	getCode(udid string) (*Code, error)
+	consumeCode(udid string) (*Code, error)
+	consumeCodeValue(udid string, value string) (*Code, error)
+}
+
+// NewCodeStoreFromEnv returns the CodeStore backend configured in the given Environment, defaulting to memory.
+// Codes are isolated by namespace, which is the tenant name, or empty when there is a single tenant
+func NewCodeStoreFromEnv(env Environment, namespace string) (CodeStore, error) {
+	switch backend := env[EnvCodeStore]; backend {
+	case "", CodeStoreMemory:
+		return NewMemoryCodeStore(), nil
+	case CodeStoreBolt:
+		path := env[EnvCodeStorePath]
+		if path == "" {
+			return nil, fmt.Errorf("%s code store requires %s to be set", CodeStoreBolt, EnvCodeStorePath)
+		}
+		return NewBoltCodeStore(path, namespace)
+	case CodeStoreRedis:
+		u := env[EnvCodeStoreRedisUrl]
+		if u == "" {
+			return nil, fmt.Errorf("%s code store requires %s to be set", CodeStoreRedis, EnvCodeStoreRedisUrl)
+		}
+		return NewRedisCodeStore(u, namespace)
+	default:
+		return nil, fmt.Errorf("invalid code store: %s", backend)
 	}
 }
 
-// NewCode generates a new Code object with a random value and an expiry time of 2 minutes from now.
-// The Code object is associated with the given UDID and stored in the CodeStore.
-// Returns the newly created Code object and any errors encountered during the process.
-func (c *CodeStore) NewCode(udid string) (code *Code, err error) {
+// newCode generates a new Code object with a random value and an expiry time of 2 minutes from now.
+// command is the name of the command to send once the code is proven, or empty if the client sends the command itself.
+// token is the name of the client token which requested the code
+func newCode(command string, token string) (*Code, error) {
 	v, err := util.RandomBytes(32, true)
 	if err != nil {
 		return nil, errors.CodeGenFailed.Wrap(err)
 	}
 
-	code = &Code{
+	code := &Code{
 		value:   v,
-		expires: time.Now().Add(2 * time.Minute),
+		expires: time.Now().Add(codeLifetime),
+		command: command,
+		token:   token,
+	}
+
+	return code, nil
+}
+
+// MemoryCodeStore stores Code objects in memory and provides a mutex for safe concurrent access
+type MemoryCodeStore struct {
+	sync.RWMutex
+	codes map[string]Code
+}
+
+// NewMemoryCodeStore creates a new instance of MemoryCodeStore with an empty map of codes
+func NewMemoryCodeStore() *MemoryCodeStore {
+	return &MemoryCodeStore{
+		codes: make(map[string]Code),
+	}
+}
+
+// NewCode generates a new Code object, see newCode.
+// The Code object is associated with the given UDID and stored in the MemoryCodeStore.
+// Returns the newly created Code object and any errors encountered during the process.
+func (c *MemoryCodeStore) NewCode(udid string, command string, token string) (code *Code, err error) {
+	code, err = newCode(command, token)
+	if err != nil {
+		return nil, err
 	}
 
 	c.Lock()
@@ -52,7 +132,7 @@ func (c *CodeStore) NewCode(udid string) (code *Code, err error) {
 }
 
 // ExpireCode will force the expiry of a code for the given UDID
-func (c *CodeStore) ExpireCode(udid string) {
+func (c *MemoryCodeStore) ExpireCode(udid string) {
 	c.Lock()
 	defer c.Unlock()
 
@@ -61,8 +141,50 @@ func (c *CodeStore) ExpireCode(udid string) {
 	delete(c.codes, udid)
 }
 
-// Prune is a goroutine that runs every given interval and removes expired codes from the CodeStore
-func (c *CodeStore) Prune(every time.Duration) {
+// ListCodes returns the CodeInfo of every unexpired Code in the MemoryCodeStore, ordered by expiry
+func (c *MemoryCodeStore) ListCodes() ([]CodeInfo, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	codes := make([]CodeInfo, 0, len(c.codes))
+	for udid, code := range c.codes {
+		if !code.isExpired() {
+			codes = append(codes, code.info(udid))
+		}
+	}
+	sortCodeInfo(codes)
+
+	return codes, nil
+}
+
+// RevokeCode removes the unexpired Code for the given UDID
+func (c *MemoryCodeStore) RevokeCode(udid string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	code, ok := c.codes[udid]
+	if !ok || code.isExpired() {
+		return errors.CodeNotFound
+	}
+
+	delete(c.codes, udid)
+
+	return nil
+}
+
+// FlushCodes removes every Code from the MemoryCodeStore
+func (c *MemoryCodeStore) FlushCodes() (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	n := len(c.codes)
+	c.codes = make(map[string]Code)
+
+	return n, nil
+}
+
+// Prune is a goroutine that runs every given interval and removes expired codes from the MemoryCodeStore
+func (c *MemoryCodeStore) Prune(every time.Duration) {
 	for range time.Tick(every) {
 		logger.Debug("pruning expired codes")
 		c.Lock()
@@ -77,7 +199,7 @@ func (c *CodeStore) Prune(every time.Duration) {
 }
 
 // getCode returns the Code object for the given UDID if it exists and is not expired.
-func (c *CodeStore) getCode(udid string) (*Code, error) {
+func (c *MemoryCodeStore) getCode(udid string) (*Code, error) {
 	c.RLock()
 	defer c.RUnlock()
 
@@ -94,6 +216,63 @@ func (c *CodeStore) getCode(udid string) (*Code, error) {
 	return &code, nil
 }
 
+// consumeCode atomically returns and removes the Code object for the given UDID if it exists and is not expired.
+func (c *MemoryCodeStore) consumeCode(udid string) (*Code, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	logger.Debugf("consuming code for %s", udid)
+
+	code, ok := c.codes[udid]
+	if !ok {
+		return nil, errors.CodeNotFound
+	}
+
+	delete(c.codes, udid)
+
+	if code.isExpired() {
+		logger.Debugf("code for %s expired at: %s", udid, code.expires)
+		return nil, errors.CodeExpired
+	}
+
+	return &code, nil
+}
+
+// consumeCodeValue atomically returns and removes the Code object for the given UDID if it has the given value
+// and is not expired. errors.CodeNotFound is returned if the UDID has no Code, or a Code with a different value.
+func (c *MemoryCodeStore) consumeCodeValue(udid string, value string) (*Code, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	logger.Debugf("consuming code for %s", udid)
+
+	code, ok := c.codes[udid]
+	if !ok || code.value != value {
+		return nil, errors.CodeNotFound
+	}
+
+	delete(c.codes, udid)
+
+	if code.isExpired() {
+		logger.Debugf("code for %s expired at: %s", udid, code.expires)
+		return nil, errors.CodeExpired
+	}
+
+	return &code, nil
+}
+
+// info returns the CodeInfo for the Code of the given UDID
+func (c *Code) info(udid string) CodeInfo {
+	return CodeInfo{Udid: udid, Expires: c.expires, Command: c.command, Token: c.token}
+}
+
+// sortCodeInfo orders codes by expiry, soonest first
+func sortCodeInfo(codes []CodeInfo) {
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i].Expires.Before(codes[j].Expires)
+	})
+}
+
 // isExpired returns true if the code has expired
 func (c *Code) isExpired() bool {
 	if time.Now().After(c.expires) {
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	e "errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const testUdid = "55900BDC-347C-58B1-D249-F32244B11D30"
+
+// newTestRedisCodeStore returns a RedisCodeStore in the given namespace, backed by an in-process fake Redis server
+func newTestRedisCodeStore(t *testing.T, mr *miniredis.Miniredis, namespace string) *RedisCodeStore {
+	t.Helper()
+
+	c, err := NewRedisCodeStore("redis://"+mr.Addr(), namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.client.Close() })
+
+	return c
+}
+
+// testCodeStores returns an empty store of each backend
+func testCodeStores(t *testing.T) map[string]CodeStore {
+	t.Helper()
+
+	bolt, err := NewBoltCodeStore(filepath.Join(t.TempDir(), "codes.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]CodeStore{
+		CodeStoreMemory: NewMemoryCodeStore(),
+		CodeStoreBolt:   bolt,
+		CodeStoreRedis:  newTestRedisCodeStore(t, miniredis.RunT(t), ""),
+	}
+}
+
+func TestCodeStoreNewCode(t *testing.T) {
+	for backend, c := range testCodeStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			code, err := c.NewCode(testUdid, CommandEraseDevice, "loaner-erase")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := c.getCode(testUdid)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.value != code.value || got.command != CommandEraseDevice || got.token != "loaner-erase" ||
+				!got.expires.Equal(code.expires) {
+				t.Errorf("stored code %+v does not match issued code %+v", got, code)
+			}
+
+			next, err := c.NewCode(testUdid, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ = c.getCode(testUdid); got.value != next.value || next.value == code.value {
+				t.Error("new code did not replace the previous code")
+			}
+		})
+	}
+}
+
+func TestCodeStoreConsumeCodeOnce(t *testing.T) {
+	for backend, c := range testCodeStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			code, err := c.NewCode(testUdid, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// consumers race for the code, as client requests and webhooks on several replicas would
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			consumed := 0
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					got, err := c.consumeCode(testUdid)
+					if err == nil {
+						mu.Lock()
+						consumed++
+						mu.Unlock()
+						if got.value != code.value {
+							t.Error("consumed code does not match issued code")
+						}
+					} else if !e.Is(err, errors.CodeNotFound) {
+						t.Errorf("unexpected error: %s", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if consumed != 1 {
+				t.Errorf("code consumed %d times, want 1", consumed)
+			}
+
+			if _, err = c.getCode(testUdid); !e.Is(err, errors.CodeNotFound) {
+				t.Errorf("expected code to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCodeStoreConsumeCodeValue(t *testing.T) {
+	for backend, c := range testCodeStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			old, err := c.NewCode(testUdid, CommandDeviceLock, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			code, err := c.NewCode(testUdid, CommandDeviceLock, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = c.consumeCodeValue(testUdid, old.value); !e.Is(err, errors.CodeNotFound) {
+				t.Errorf("expected replaced code not to be consumed, got %v", err)
+			}
+
+			if _, err = c.getCode(testUdid); err != nil {
+				t.Errorf("expected current code to be kept, got %v", err)
+			}
+
+			if _, err = c.consumeCodeValue(testUdid, code.value); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = c.consumeCodeValue(testUdid, code.value); !e.Is(err, errors.CodeNotFound) {
+				t.Errorf("expected code to be consumed once, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCodeStoreAdmin(t *testing.T) {
+	for backend, c := range testCodeStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			other := "0E8F3A52-8C1E-4E1B-9A0F-1F6E2C3D4B5A"
+			for _, udid := range []string{testUdid, other} {
+				if _, err := c.NewCode(udid, "", ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			codes, err := c.ListCodes()
+			if err != nil || len(codes) != 2 {
+				t.Fatalf("expected 2 codes, got %v (%v)", codes, err)
+			}
+
+			if err = c.RevokeCode(testUdid); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = c.RevokeCode(testUdid); !e.Is(err, errors.CodeNotFound) {
+				t.Errorf("expected revoked code not to be found, got %v", err)
+			}
+
+			if n, err := c.FlushCodes(); err != nil || n != 1 {
+				t.Errorf("expected 1 code flushed, got %d (%v)", n, err)
+			}
+		})
+	}
+}
+
+func TestRedisCodeStoreTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := newTestRedisCodeStore(t, mr, "")
+
+	if _, err := c.NewCode(testUdid, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := mr.TTL(redisKeyPrefix + testUdid); ttl <= 0 || ttl > codeLifetime {
+		t.Errorf("expected a TTL of up to %s, got %s", codeLifetime, ttl)
+	}
+
+	mr.FastForward(codeLifetime + time.Second)
+
+	if _, err := c.getCode(testUdid); !e.Is(err, errors.CodeNotFound) {
+		t.Errorf("expected code to expire, got %v", err)
+	}
+
+	if _, err := c.consumeCode(testUdid); !e.Is(err, errors.CodeNotFound) {
+		t.Errorf("expected expired code not to be consumed, got %v", err)
+	}
+}
+
+func TestRedisCodeStoreNamespaces(t *testing.T) {
+	mr := miniredis.RunT(t)
+	single := newTestRedisCodeStore(t, mr, "")
+	acme := newTestRedisCodeStore(t, mr, "acme")
+	globex := newTestRedisCodeStore(t, mr, "globex")
+
+	for _, c := range []*RedisCodeStore{single, acme, globex} {
+		if _, err := c.NewCode(testUdid, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, err := acme.consumeCode(testUdid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]*RedisCodeStore{"single": single, "globex": globex} {
+		got, err := c.getCode(testUdid)
+		if err != nil {
+			t.Fatalf("%s: expected code to be kept, got %v", name, err)
+		}
+		if got.value == code.value {
+			t.Errorf("%s: code shared with another namespace", name)
+		}
+
+		codes, err := c.ListCodes()
+		if err != nil || len(codes) != 1 {
+			t.Errorf("%s: expected 1 code listed, got %v (%v)", name, codes, err)
+		}
+	}
+
+	if n, err := single.FlushCodes(); err != nil || n != 1 {
+		t.Fatalf("expected 1 code flushed, got %d (%v)", n, err)
+	}
+
+	if _, err = globex.getCode(testUdid); err != nil {
+		t.Errorf("flush removed another namespace's code: %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"command-on-demand/internal/jamf"
+	"command-on-demand/internal/logger"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Command names, used in logs and responses
+const (
+	CommandEraseDevice    = "EraseDevice"
+	CommandDeviceLock     = "DeviceLock"
+	CommandSoftwareUpdate = "SoftwareUpdate"
+	CommandRestartDevice  = "RestartDevice"
+	CommandShutDownDevice = "ShutDownDevice"
+)
+
+// commandAliases maps the short command names used in request paths and parameters to command names
+var commandAliases = map[string]string{
+	"erase":    CommandEraseDevice,
+	"lock":     CommandDeviceLock,
+	"swupd":    CommandSoftwareUpdate,
+	"restart":  CommandRestartDevice,
+	"shutdown": CommandShutDownDevice,
+}
+
+// sentMessages are the response messages of commands whose message predates sendCommand,
+// other commands respond with "<name> command sent"
+var sentMessages = map[string]string{
+	CommandEraseDevice:    "EraseDevice command sent. Prepare thyself!",
+	CommandSoftwareUpdate: "Software Update command sent",
+}
+
+// commandBuilder returns the Commander to send to a computer which has passed validateRequest.
+// Lookups made while building use the given Client, which is bound to the request's deadline, see sendCommand
+type commandBuilder func(c *jamf.Client, comp jamf.Computer) (jamf.Commander, error)
+
+// sendCommand validates the request, then builds and sends the named command to the validated computer.
+// Every invocation is recorded as a Job. The outcome is written to the response, unless the request sets the async
+// query parameter, in which case the job is accepted straight away and its outcome must be polled, see JobHandler.
+func (s Server) sendCommand(w http.ResponseWriter, r *http.Request, name string, build commandBuilder) {
+	// rejections before validateRequest are audited too, so every denied attempt to send a command is recorded
+	udid, err := s.checkUDID(r)
+	rec := newAuditRecord(r, name, udid)
+	if err == nil {
+		err = s.checkScope(r, name)
+	}
+
+	if err != nil {
+		s.auditValidation(rec, jamf.Computer{}, err)
+		writeErrorResponse(w, err)
+		return
+	}
+
+	// everything used from the request is read now, as async commands run after the handler has returned
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+	keys := s.Lockout.lockoutKeys(r, udid)
+
+	job := s.JobStore.NewJob(name, udid, rec.token)
+	logger.WithFields(map[string]interface{}{
+		"tenant":  s.tenant,
+		"token":   rec.token,
+		"command": name,
+		"udid":    udid,
+		"jobId":   job.Id,
+	}).Info("command requested")
+
+	run := func() error {
+		comp, err := s.validateRequest(rec, keys)
+		if aErr := s.auditValidation(rec, comp, err); err == nil {
+			err = aErr
+		}
+		if err != nil {
+			s.JobStore.setState(job.Id, JobStateFailed, err)
+			return err
+		}
+
+		cmd, err := s.buildAndSend(comp, name, build)
+		s.auditCommand(rec, comp, cmd, err)
+		s.notifyCommand(rec, job.Id, comp, cmd, err)
+		if err != nil {
+			s.JobStore.setState(job.Id, JobStateFailed, err)
+			return err
+		}
+
+		s.JobStore.setSent(job.Id, comp, cmd.CommandType())
+		return nil
+	}
+
+	if async {
+		go run()
+		writeJobResponse(w, http.StatusAccepted, fmt.Sprintf("%s command accepted", name), job.Id)
+		return
+	}
+
+	// the response must be written before the write timeout, so waiting on Jamf is bounded by JamfDeadline
+	ctx, cancel := context.WithTimeout(r.Context(), JamfDeadline)
+	defer cancel()
+	s.jamf = s.jamf.WithContext(ctx)
+
+	if err = run(); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	msg, ok := sentMessages[name]
+	if !ok {
+		msg = fmt.Sprintf("%s command sent", name)
+	}
+
+	writeJobResponse(w, http.StatusCreated, msg, job.Id)
+}
+
+// buildAndSend builds the named command for the validated computer and sends it to Jamf, returning the sent command.
+// The command is refused if the device is in cooldown for the command, or the destructive command budget is exceeded
+func (s Server) buildAndSend(comp jamf.Computer, name string, build commandBuilder) (jamf.Commander, error) {
+	release, err := s.Guard.reserve(name, comp.Udid)
+	if err != nil {
+		logger.Errorf("%s command to %s refused: %s", name, comp.Udid, err)
+		return nil, err
+	}
+
+	cmd, err := build(s.jamf, comp)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	err = s.jamf.SendCommand(cmd)
+	if err != nil {
+		release()
+		logger.Errorf("failed to send %s command: %s", name, err)
+		return nil, err
+	}
+
+	logger.Infof("%s command sent successfully to computer id %d (serial: %s)", name, comp.Id, comp.SerialNumber)
+
+	if pc, ok := cmd.(pinCommander); ok {
+		s.escrowPin(comp, name, pc.Pin())
+	}
+
+	return cmd, nil
+}
+
+// defaultBuilder returns the commandBuilder for the named command with default parameters,
+// as used for commands which are sent without a client request, see JamfWebhookHandler
+func (s Server) defaultBuilder(name string) (commandBuilder, bool) {
+	switch name {
+	case CommandEraseDevice:
+		return s.eraseDeviceBuilder(), true
+	case CommandDeviceLock:
+		return s.deviceLockBuilder(deviceLockRequest{}), true
+	case CommandSoftwareUpdate:
+		return s.softwareUpdateBuilder(newSoftwareUpdateRequest()), true
+	case CommandRestartDevice:
+		return s.restartDeviceBuilder(), true
+	case CommandShutDownDevice:
+		return s.shutDownDeviceBuilder(), true
+	}
+
+	return nil, false
+}
+
+// eraseDeviceBuilder returns a commandBuilder for EraseDevice using the configured erase backend
+func (s Server) eraseDeviceBuilder() commandBuilder {
+	return func(c *jamf.Client, comp jamf.Computer) (jamf.Commander, error) {
+		erase := s.cfg().erase
+		if erase.backend == EraseBackendPro {
+			if err := c.ResolveManagementId(&comp); err != nil {
+				logger.Error("could not resolve management ID: ", err)
+				return nil, err
+			}
+		}
+
+		pin, err := newPin()
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Debugf("sending EraseDevice command via %s backend", erase.backend)
+
+		if erase.backend == EraseBackendClassic {
+			return jamf.NewEraseDeviceCommand(comp, pin), nil
+		}
+
+		return jamf.NewEraseDeviceMdmCommand(comp, pin, erase.options), nil
+	}
+}
+
+// deviceLockRequest is the optional JSON body accepted by DeviceLockHandler
+type deviceLockRequest struct {
+	Message     string `json:"message"`
+	PhoneNumber string `json:"phoneNumber"`
+}
+
+// deviceLockBuilder returns a commandBuilder for DeviceLock with the given parameters
+func (s Server) deviceLockBuilder(params deviceLockRequest) commandBuilder {
+	return func(c *jamf.Client, comp jamf.Computer) (jamf.Commander, error) {
+		pin, err := newPin()
+		if err != nil {
+			return nil, err
+		}
+
+		return jamf.NewDeviceLockCommand(comp, pin, params.Message, params.PhoneNumber), nil
+	}
+}
+
+// softwareUpdateRequest is the optional JSON body accepted by SoftwareUpdateHandler.
+// Fields omitted from the body keep the values of the jamf.ForceInstallLatest preset.
+type softwareUpdateRequest struct {
+	TargetVersion    string `json:"targetVersion"`
+	SkipVerify       bool   `json:"skipVersionVerification"`
+	UpdateAction     string `json:"updateAction"`
+	MaxDeferrals     int    `json:"maxDeferrals"`
+	ForceRestart     bool   `json:"forceRestart"`
+	ApplyMajorUpdate bool   `json:"applyMajorUpdate"`
+	Priority         string `json:"priority"`
+}
+
+// newSoftwareUpdateRequest returns a softwareUpdateRequest populated with the ForceInstallLatest defaults
+func newSoftwareUpdateRequest() softwareUpdateRequest {
+	return softwareUpdateRequest{
+		SkipVerify:       true,
+		UpdateAction:     jamf.UpdateActionDownloadAndInstall,
+		MaxDeferrals:     0,
+		ForceRestart:     true,
+		ApplyMajorUpdate: true,
+		Priority:         jamf.UpdatePriorityHigh,
+	}
+}
+
+// config validates the request and returns the equivalent jamf.SoftwareUpdateCommandConfig
+func (u softwareUpdateRequest) config() (jamf.SoftwareUpdateCommandConfig, error) {
+	return jamf.NewSoftwareUpdateConfig(u.TargetVersion, u.SkipVerify, u.UpdateAction, u.MaxDeferrals,
+		u.ForceRestart, u.ApplyMajorUpdate, u.Priority)
+}
+
+// softwareUpdateBuilder returns a commandBuilder for a Software Update with the given parameters,
+// bounded by the software update policy
+func (s Server) softwareUpdateBuilder(params softwareUpdateRequest) commandBuilder {
+	return func(c *jamf.Client, comp jamf.Computer) (jamf.Commander, error) {
+		err := s.cfg().swupdPolicy.Apply(&params, comp, time.Now())
+		if err != nil {
+			logger.Error("software update policy check failed: ", err)
+			return nil, err
+		}
+
+		conf, err := params.config()
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Debugf("sending Software Update command with parameters: %+v", params)
+		return jamf.NewSoftwareUpdateCommand(comp, conf), nil
+	}
+}
+
+// restartDeviceBuilder returns a commandBuilder for RestartDevice
+func (s Server) restartDeviceBuilder() commandBuilder {
+	return func(c *jamf.Client, comp jamf.Computer) (jamf.Commander, error) {
+		if err := c.ResolveManagementId(&comp); err != nil {
+			logger.Error("could not resolve management ID: ", err)
+			return nil, err
+		}
+
+		return jamf.NewRestartDeviceCommand(comp), nil
+	}
+}
+
+// shutDownDeviceBuilder returns a commandBuilder for ShutDownDevice
+func (s Server) shutDownDeviceBuilder() commandBuilder {
+	return func(c *jamf.Client, comp jamf.Computer) (jamf.Commander, error) {
+		if err := c.ResolveManagementId(&comp); err != nil {
+			logger.Error("could not resolve management ID: ", err)
+			return nil, err
+		}
+
+		return jamf.NewShutDownDeviceCommand(comp), nil
+	}
+}
@@ -0,0 +1,443 @@
+package server
+
+import (
+	"command-on-demand/internal/notify"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// settingKind is the type of value a setting accepts, used to validate the config file
+type settingKind int
+
+const (
+	kindString settingKind = iota
+	kindInt
+	kindDuration
+	kindDurationOrZero
+	kindBool
+	kindList
+	kindPort
+)
+
+func (k settingKind) String() string {
+	switch k {
+	case kindInt:
+		return "a non-negative integer"
+	case kindDuration:
+		return "a duration, e.g. 90s or 1h"
+	case kindDurationOrZero:
+		return "a duration, e.g. 90s or 1h, or 0"
+	case kindBool:
+		return "true or false"
+	case kindList:
+		return "a list"
+	case kindPort:
+		return "a port number from 1 to 65535"
+	}
+
+	return "a string"
+}
+
+// settings is the schema of the config file, mapping each Environment key to the kind of value it accepts.
+// Settings which cannot be changed in the file, such as EnvConfigFile itself, are not listed
+var settings = map[string]settingKind{
+	EnvJamfFQDN:                  kindString,
+	EnvJamfAPIUser:               kindString,
+	EnvJamfAPIPassword:           kindString,
+	EnvJamfAuthMode:              kindString,
+	EnvJamfClientId:              kindString,
+	EnvJamfClientSecret:          kindString,
+	EnvServerBearerToken:         kindString,
+	EnvServerBearerTokenPrevious: kindList,
+	EnvCodeProofExtAttName:       kindString,
+	EnvServiceListenInterface:    kindString,
+	EnvServiceListenPort:         kindPort,
+	EnvAdminBearerToken:          kindString,
+	EnvAdminListenPort:           kindPort,
+	EnvPinEscrowExtAttName:       kindString,
+	EnvJamfWebhookSecret:         kindString,
+	EnvJamfWebhookUser:           kindString,
+	EnvJamfWebhookPassword:       kindString,
+	EnvCommands:                  kindList,
+	EnvClientTokensFile:          kindString,
+	EnvLogLevel:                  kindString,
+	EnvAuditLogPath:              kindString,
+	EnvAuditHMACKey:              kindString,
+
+	EnvWebhookQueueSize:      kindInt,
+	EnvWebhookWorkers:        kindInt,
+	EnvWebhookMaxAttempts:    kindInt,
+	EnvWebhookRetryBaseDelay: kindDuration,
+	EnvWebhookRetryMaxDelay:  kindDuration,
+	EnvWebhookTimeout:        kindDuration,
+	EnvWebhookDeadLetterPath: kindString,
+
+	EnvJamfComputerLookup:   kindString,
+	EnvJamfTimeout:          kindDuration,
+	EnvJamfMaxRetries:       kindInt,
+	EnvJamfRetryBaseDelay:   kindDuration,
+	EnvJamfRetryMaxDelay:    kindDuration,
+	EnvJamfBreakerThreshold: kindInt,
+	EnvJamfBreakerCooldown:  kindDuration,
+
+	EnvCodeStore:         kindString,
+	EnvCodeStorePath:     kindString,
+	EnvCodeStoreRedisUrl: kindString,
+
+	EnvLockoutFailureThreshold:     kindInt,
+	EnvLockoutCodeRequestThreshold: kindInt,
+	EnvLockoutWindow:               kindDuration,
+	EnvLockoutCooldown:             kindDuration,
+	EnvTrustProxyHeaders:           kindBool,
+
+	EnvCooldownErase:           kindDurationOrZero,
+	EnvCooldownLock:            kindDurationOrZero,
+	EnvCooldownSwupd:           kindDurationOrZero,
+	EnvCooldownRestart:         kindDurationOrZero,
+	EnvCooldownShutdown:        kindDurationOrZero,
+	EnvDestructiveBudget:       kindInt,
+	EnvDestructiveBudgetWindow: kindDuration,
+
+	EnvCommandTrackInterval: kindDuration,
+	EnvCommandPendingWarn:   kindDuration,
+	EnvCommandTrackTimeout:  kindDuration,
+
+	EnvSwupdPolicyMode:              kindString,
+	EnvSwupdPolicyMaxVersion:        kindString,
+	EnvSwupdPolicyDenyMajorGroups:   kindList,
+	EnvSwupdPolicyForceRestartHours: kindString,
+	EnvSwupdPolicyMaxDeferrals:      kindInt,
+
+	EnvEraseBackend:                kindString,
+	EnvEraseObliterationBehavior:   kindString,
+	EnvErasePreserveDataPlan:       kindBool,
+	EnvEraseDisallowProximitySetup: kindBool,
+	EnvEraseReturnToService:        kindBool,
+	EnvEraseRTSWifiProfilePath:     kindString,
+
+	EnvJamfAPIPassword + secretFileSuffix:           kindString,
+	EnvJamfClientSecret + secretFileSuffix:          kindString,
+	EnvServerBearerToken + secretFileSuffix:         kindString,
+	EnvServerBearerTokenPrevious + secretFileSuffix: kindString,
+	EnvAdminBearerToken + secretFileSuffix:          kindString,
+	EnvJamfWebhookSecret + secretFileSuffix:         kindString,
+	EnvJamfWebhookPassword + secretFileSuffix:       kindString,
+	EnvCodeStoreRedisUrl + secretFileSuffix:         kindString,
+	EnvWebhooks + secretFileSuffix:                  kindString,
+	EnvAuditHMACKey + secretFileSuffix:              kindString,
+}
+
+const (
+	// configClientTokens is the config file key for client tokens, which are stored in EnvClientTokens as JSON
+	configClientTokens = "client_tokens"
+	// configWebhooks is the config file key for outbound webhook targets, which are stored in EnvWebhooks as JSON
+	configWebhooks = "webhooks"
+	// configTenants is the config file key for tenants, whose settings are stored under their tenant namespace
+	configTenants = "tenants"
+)
+
+// loadConfigFile reads the YAML config file at the given path and returns its settings as an Environment, keyed as
+// they would be without the CMDOD_ prefix. Nested keys are joined with underscores, so these are equivalent:
+//
+//	jamf:
+//	  fqdn: yourorg.jamfcloud.com
+//	jamf_fqdn: yourorg.jamfcloud.com
+//
+// Tenants are given under the tenants key, and their settings are keyed under their tenant namespace,
+// e.g. T_ACME_JAMF_FQDN. Every setting is validated against the settings schema; errors include the file and line.
+// An empty path returns an empty Environment
+func loadConfigFile(path string) (Environment, error) {
+	e := make(Environment)
+	if path == "" {
+		return e, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if len(doc.Content) == 0 {
+		return e, nil
+	}
+
+	l := configLoader{path: path, env: e}
+	if err = l.load(doc.Content[0], "", nil, 0, true); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// configLoader flattens a YAML config file into an Environment
+type configLoader struct {
+	path string
+	env  Environment
+}
+
+// errorf returns an error prefixed with the config file path and the line of the given node
+func (l configLoader) errorf(n *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", l.path, n.Line, fmt.Sprintf(format, args...))
+}
+
+// load flattens a mapping node into the Environment. prefix is the Environment key prefix of a tenant,
+// path is the path of keys to the node, of which those from index base build the Environment key, and top is true
+// for the document root and the root of each tenant, where client tokens and webhook targets may be given
+func (l configLoader) load(n *yaml.Node, prefix string, path []string, base int, top bool) error {
+	if n.Kind != yaml.MappingNode {
+		return l.errorf(n, "%s must be a mapping", displayPath(path))
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		p := append(append([]string{}, path...), k.Value)
+
+		switch {
+		case top && k.Value == configClientTokens:
+			if err := l.loadClientTokens(v, prefix); err != nil {
+				return err
+			}
+		case top && k.Value == configWebhooks:
+			if err := l.loadWebhooks(v, prefix); err != nil {
+				return err
+			}
+		case top && prefix == "" && k.Value == configTenants:
+			if err := l.loadTenants(v); err != nil {
+				return err
+			}
+		case v.Kind == yaml.MappingNode:
+			if err := l.load(v, prefix, p, base, false); err != nil {
+				return err
+			}
+		default:
+			if err := l.loadSetting(k, v, prefix, p, base); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadSetting validates a single setting against the schema and sets it in the Environment
+func (l configLoader) loadSetting(k *yaml.Node, v *yaml.Node, prefix string, path []string, base int) error {
+	key := strings.ToUpper(strings.Join(path[base:], "_"))
+	kind, ok := settings[key]
+	if !ok {
+		return l.errorf(k, "unknown setting %s", displayPath(path))
+	}
+
+	var value string
+	switch v.Kind {
+	case yaml.ScalarNode:
+		value = v.Value
+	case yaml.SequenceNode:
+		if kind != kindList {
+			return l.errorf(v, "%s must be %s, not a list", displayPath(path), kind)
+		}
+
+		items := make([]string, 0, len(v.Content))
+		for _, item := range v.Content {
+			if item.Kind != yaml.ScalarNode || strings.Contains(item.Value, ",") {
+				return l.errorf(item, "%s items must be values without commas", displayPath(path))
+			}
+			items = append(items, item.Value)
+		}
+		value = strings.Join(items, ",")
+	default:
+		return l.errorf(v, "%s must be %s", displayPath(path), kind)
+	}
+
+	if err := validateSetting(kind, value); err != nil {
+		return l.errorf(v, "%s must be %s, got '%s'", displayPath(path), kind, value)
+	}
+
+	l.env[prefix+key] = value
+
+	return nil
+}
+
+// validateSetting returns an error if the value is not valid for the kind of setting
+func validateSetting(kind settingKind, value string) error {
+	switch kind {
+	case kindInt:
+		if i, err := strconv.Atoi(value); err != nil || i < 0 {
+			return fmt.Errorf("invalid integer")
+		}
+	case kindDuration:
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration")
+		}
+	case kindDurationOrZero:
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid duration")
+		}
+	case kindBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid boolean")
+		}
+	case kindPort:
+		if !validPort(value) {
+			return fmt.Errorf("invalid port")
+		}
+	}
+
+	return nil
+}
+
+// loadClientTokens decodes a list of client tokens and stores them in EnvClientTokens as JSON
+func (l configLoader) loadClientTokens(n *yaml.Node, prefix string) error {
+	if n.Kind != yaml.SequenceNode {
+		return l.errorf(n, "%s must be a list", configClientTokens)
+	}
+
+	var tokens []ClientToken
+	for _, item := range n.Content {
+		var t ClientToken
+		if err := l.checkFields(item, reflect.TypeOf(t), configClientTokens); err != nil {
+			return err
+		}
+		if err := item.Decode(&t); err != nil {
+			return l.errorf(item, "invalid client token: %s", err)
+		}
+		tokens = append(tokens, t)
+	}
+
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return l.errorf(n, "invalid client tokens: %s", err)
+	}
+
+	l.env[prefix+EnvClientTokens] = string(data)
+
+	return nil
+}
+
+// loadWebhooks decodes and validates a list of webhook targets and stores them in EnvWebhooks as JSON
+func (l configLoader) loadWebhooks(n *yaml.Node, prefix string) error {
+	if n.Kind != yaml.SequenceNode {
+		return l.errorf(n, "%s must be a list", configWebhooks)
+	}
+
+	var targets []notify.Target
+	for _, item := range n.Content {
+		var t notify.Target
+		if err := l.checkFields(item, reflect.TypeOf(t), configWebhooks); err != nil {
+			return err
+		}
+		if err := item.Decode(&t); err != nil {
+			return l.errorf(item, "invalid webhook target: %s", err)
+		}
+		targets = append(targets, t)
+	}
+
+	data, err := json.Marshal(targets)
+	if err != nil {
+		return l.errorf(n, "invalid webhook targets: %s", err)
+	}
+
+	if _, err = notify.ParseTargets(data); err != nil {
+		return l.errorf(n, "%s", err)
+	}
+
+	l.env[prefix+EnvWebhooks] = string(data)
+
+	return nil
+}
+
+// checkFields returns an error for the first key of a mapping node, or of the mappings nested in it, which is not
+// a field of the given struct type. yaml.v3 Node.Decode ignores unknown keys, so a misspelt setting such as
+// "comands" would otherwise be dropped without an error
+func (l configLoader) checkFields(n *yaml.Node, t reflect.Type, path string) error {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		ft, ok := fields[k.Value]
+		if !ok {
+			return l.errorf(k, "unknown setting %s.%s", path, k.Value)
+		}
+
+		for ft.Kind() == reflect.Pointer || ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+
+		if ft.Kind() != reflect.Struct || ft == reflect.TypeOf(time.Time{}) {
+			continue
+		}
+
+		items := []*yaml.Node{v}
+		if v.Kind == yaml.SequenceNode {
+			items = v.Content
+		}
+		for _, item := range items {
+			if err := l.checkFields(item, ft, path+"."+k.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadTenants loads the settings of each tenant under its tenant namespace, and sets EnvTenants to the tenant names
+func (l configLoader) loadTenants(n *yaml.Node) error {
+	if n.Kind != yaml.MappingNode {
+		return l.errorf(n, "%s must be a mapping of tenant names to settings", configTenants)
+	}
+
+	var names []string
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if !validTenantName.MatchString(k.Value) {
+			return l.errorf(k, "invalid tenant name %s, must be lower case letters, numbers and hyphens", k.Value)
+		}
+
+		prefix := strings.TrimPrefix(tenantNamespace(k.Value), envNamespace)
+		if err := l.load(v, prefix, []string{configTenants, k.Value}, 2, true); err != nil {
+			return err
+		}
+		names = append(names, k.Value)
+	}
+
+	l.env[EnvTenants] = strings.Join(names, ",")
+
+	return nil
+}
+
+// displayPath returns the dotted path of a setting for error messages
+func displayPath(path []string) string {
+	if len(path) == 0 {
+		return "document"
+	}
+
+	return strings.Join(path, ".")
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes the given YAML to a config file in a temporary directory and returns its path
+func writeConfigFile(t *testing.T, yaml string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "cmdod.yaml")
+	if err := os.WriteFile(path, []byte(strings.TrimLeft(yaml, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+jamf:
+  fqdn: yourorg.jamfcloud.com
+commands: [erase, swupd]
+lockout:
+  failure_threshold: 5
+  window: 15m
+cooldown_erase: 0
+client_tokens:
+  - name: loaner-erase
+    token: s3cret
+    commands: [erase]
+    previous:
+      - token: old
+        expires: 2030-01-01T00:00:00Z
+tenants:
+  acme:
+    jamf:
+      fqdn: acme.jamfcloud.com
+`)
+
+	env, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{
+		EnvJamfFQDN:                "yourorg.jamfcloud.com",
+		EnvCommands:                "erase,swupd",
+		EnvLockoutFailureThreshold: "5",
+		EnvLockoutWindow:           "15m",
+		EnvCooldownErase:           "0",
+		EnvTenants:                 "acme",
+		"T_ACME_" + EnvJamfFQDN:    "acme.jamfcloud.com",
+	} {
+		if env[key] != want {
+			t.Errorf("%s = '%s', want '%s'", key, env[key], want)
+		}
+	}
+
+	if !strings.Contains(env[EnvClientTokens], `"name":"loaner-erase"`) {
+		t.Errorf("client tokens not loaded: %s", env[EnvClientTokens])
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "unknown setting",
+			yaml: "jamf:\n  fqdn: a\n  fdqn: b\n",
+			want: ":3: unknown setting jamf.fdqn",
+		},
+		{
+			name: "invalid duration",
+			yaml: "lockout:\n  window: 15\n",
+			want: ":2: lockout.window must be a duration, e.g. 90s or 1h, got '15'",
+		},
+		{
+			name: "zero duration",
+			yaml: "jamf:\n  timeout: 0s\n",
+			want: ":2: jamf.timeout must be a duration",
+		},
+		{
+			name: "invalid integer",
+			yaml: "jamf_fqdn: a\nlockout:\n  failure_threshold: -1\n",
+			want: ":3: lockout.failure_threshold must be a non-negative integer",
+		},
+		{
+			name: "invalid port",
+			yaml: "admin:\n  listen_port: 99999\n",
+			want: ":2: admin.listen_port must be a port number from 1 to 65535, got '99999'",
+		},
+		{
+			name: "list for a scalar",
+			yaml: "jamf_fqdn: [a, b]\n",
+			want: ":1: jamf_fqdn must be a string, not a list",
+		},
+		{
+			name: "unknown client token field",
+			yaml: "client_tokens:\n  - name: a\n    token: b\n    comands: [erase]\n",
+			want: ":4: unknown setting client_tokens.comands",
+		},
+		{
+			name: "unknown previous token field",
+			yaml: "client_tokens:\n  - name: a\n    token: b\n    commands: [erase]\n    previous:\n      - token: c\n        expiry: 2030-01-01T00:00:00Z\n",
+			want: ":7: unknown setting client_tokens.previous.expiry",
+		},
+		{
+			name: "unknown webhook field",
+			yaml: "webhooks:\n  - name: a\n    url: https://example.com\n    event: [lockout.triggered]\n",
+			want: ":4: unknown setting webhooks.event",
+		},
+		{
+			name: "invalid tenant name",
+			yaml: "tenants:\n  Acme:\n    jamf_fqdn: a\n",
+			want: ":2: invalid tenant name Acme",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.yaml)
+
+			_, err := loadConfigFile(path)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if !strings.HasPrefix(err.Error(), path+tt.want) {
+				t.Errorf("got error '%s', want '%s%s'", err, path, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	started := Environment{EnvJamfFQDN: "a", EnvLockoutWindow: "15m", EnvCommands: "erase"}
+	tn := &Tenants{
+		names:   []string{"", "acme"},
+		started: map[string]Environment{"": started, "acme": started},
+	}
+
+	reloaded := Environment{EnvJamfFQDN: "a", EnvLockoutWindow: "1h", EnvCommands: "erase,swupd"}
+	changed := tn.restartRequired(map[string]Environment{"": started, "acme": reloaded})
+
+	if len(changed) != 1 || changed[0] != "CMDOD_T_ACME_"+EnvLockoutWindow {
+		t.Errorf("expected only the acme lockout window to require a restart, got %v", changed)
+	}
+}
@@ -3,57 +3,313 @@ package server
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Environment map[string]string
 
 // Environment variable keys/names
 const (
-	EnvJamfFQDN               = "JAMF_FQDN"
-	EnvJamfAPIUser            = "JAMF_API_USER"
-	EnvJamfAPIPassword        = "JAMF_API_PASSWORD"
-	EnvServerBearerToken      = "SERVER_BEARER_TOKEN"
-	EnvCodeProofExtAttName    = "CODE_PROOF_EA_NAME"
-	EnvServiceListenInterface = "SERVER_LISTEN_INTERFACE"
-	EnvServiceListenPort      = "SERVER_LISTEN_PORT"
+	EnvJamfFQDN                  = "JAMF_FQDN"
+	EnvJamfAPIUser               = "JAMF_API_USER"
+	EnvJamfAPIPassword           = "JAMF_API_PASSWORD"
+	EnvJamfAuthMode              = "JAMF_AUTH_MODE"
+	EnvJamfClientId              = "JAMF_CLIENT_ID"
+	EnvJamfClientSecret          = "JAMF_CLIENT_SECRET"
+	EnvTenants                   = "TENANTS"
+	EnvServerBearerToken         = "SERVER_BEARER_TOKEN"
+	EnvServerBearerTokenPrevious = "SERVER_BEARER_TOKEN_PREVIOUS"
+	EnvCodeProofExtAttName       = "CODE_PROOF_EA_NAME"
+	EnvServiceListenInterface    = "SERVER_LISTEN_INTERFACE"
+	EnvServiceListenPort         = "SERVER_LISTEN_PORT"
+	EnvAdminBearerToken          = "ADMIN_BEARER_TOKEN"
+	EnvAdminListenPort           = "ADMIN_LISTEN_PORT"
+	EnvPinEscrowExtAttName       = "PIN_ESCROW_EA_NAME"
+	EnvJamfWebhookSecret         = "JAMF_WEBHOOK_SECRET"
+	EnvJamfWebhookUser           = "JAMF_WEBHOOK_USER"
+	EnvJamfWebhookPassword       = "JAMF_WEBHOOK_PASSWORD"
+	EnvCommands                  = "COMMANDS"
+	EnvClientTokensFile          = "CLIENT_TOKENS_FILE"
+	EnvClientTokens              = "CLIENT_TOKENS"
+	EnvConfigFile                = "CONFIG_FILE"
+	EnvLogLevel                  = "LOG_LEVEL"
+	EnvAuditLogPath              = "AUDIT_LOG_PATH"
+	EnvAuditHMACKey              = "AUDIT_HMAC_KEY"
+
+	EnvWebhooks              = "WEBHOOKS"
+	EnvWebhookQueueSize      = "WEBHOOK_QUEUE_SIZE"
+	EnvWebhookWorkers        = "WEBHOOK_WORKERS"
+	EnvWebhookMaxAttempts    = "WEBHOOK_MAX_ATTEMPTS"
+	EnvWebhookRetryBaseDelay = "WEBHOOK_RETRY_BASE_DELAY"
+	EnvWebhookRetryMaxDelay  = "WEBHOOK_RETRY_MAX_DELAY"
+	EnvWebhookTimeout        = "WEBHOOK_TIMEOUT"
+	EnvWebhookDeadLetterPath = "WEBHOOK_DEAD_LETTER_PATH"
+
+	EnvJamfComputerLookup   = "JAMF_COMPUTER_LOOKUP"
+	EnvJamfTimeout          = "JAMF_TIMEOUT"
+	EnvJamfMaxRetries       = "JAMF_MAX_RETRIES"
+	EnvJamfRetryBaseDelay   = "JAMF_RETRY_BASE_DELAY"
+	EnvJamfRetryMaxDelay    = "JAMF_RETRY_MAX_DELAY"
+	EnvJamfBreakerThreshold = "JAMF_BREAKER_THRESHOLD"
+	EnvJamfBreakerCooldown  = "JAMF_BREAKER_COOLDOWN"
+
+	EnvCodeStore         = "CODE_STORE"
+	EnvCodeStorePath     = "CODE_STORE_PATH"
+	EnvCodeStoreRedisUrl = "CODE_STORE_REDIS_URL"
+
+	EnvLockoutFailureThreshold     = "LOCKOUT_FAILURE_THRESHOLD"
+	EnvLockoutCodeRequestThreshold = "LOCKOUT_CODE_REQUEST_THRESHOLD"
+	EnvLockoutWindow               = "LOCKOUT_WINDOW"
+	EnvLockoutCooldown             = "LOCKOUT_COOLDOWN"
+	EnvTrustProxyHeaders           = "TRUST_PROXY_HEADERS"
+
+	EnvCooldownErase           = "COOLDOWN_ERASE"
+	EnvCooldownLock            = "COOLDOWN_LOCK"
+	EnvCooldownSwupd           = "COOLDOWN_SWUPD"
+	EnvCooldownRestart         = "COOLDOWN_RESTART"
+	EnvCooldownShutdown        = "COOLDOWN_SHUTDOWN"
+	EnvDestructiveBudget       = "DESTRUCTIVE_BUDGET"
+	EnvDestructiveBudgetWindow = "DESTRUCTIVE_BUDGET_WINDOW"
+
+	EnvCommandTrackInterval = "COMMAND_TRACK_INTERVAL"
+	EnvCommandPendingWarn   = "COMMAND_PENDING_WARN"
+	EnvCommandTrackTimeout  = "COMMAND_TRACK_TIMEOUT"
+
+	EnvSwupdPolicyMode              = "SWUPD_POLICY_MODE"
+	EnvSwupdPolicyMaxVersion        = "SWUPD_POLICY_MAX_VERSION"
+	EnvSwupdPolicyDenyMajorGroups   = "SWUPD_POLICY_DENY_MAJOR_GROUPS"
+	EnvSwupdPolicyForceRestartHours = "SWUPD_POLICY_FORCE_RESTART_HOURS"
+	EnvSwupdPolicyMaxDeferrals      = "SWUPD_POLICY_MAX_DEFERRALS"
+
+	EnvEraseBackend                = "ERASE_BACKEND"
+	EnvEraseObliterationBehavior   = "ERASE_OBLITERATION_BEHAVIOR"
+	EnvErasePreserveDataPlan       = "ERASE_PRESERVE_DATA_PLAN"
+	EnvEraseDisallowProximitySetup = "ERASE_DISALLOW_PROXIMITY_SETUP"
+	EnvEraseReturnToService        = "ERASE_RETURN_TO_SERVICE"
+	EnvEraseRTSWifiProfilePath     = "ERASE_RTS_WIFI_PROFILE_PATH"
 )
 
-// NewEnvironment reads all environment variables prefixed with a given namespace and returns an Environment
-// whose keys are set without the namespace prefix.
-// namespace is used to prevent collision with other OS env vars, but is then removed when set on Environment
-// An error is returned if not all required keys are present and set with a non-empty value
-func NewEnvironment(namespace string) (e Environment, err error) {
-	e = make(Environment)
+// secretFileSuffix is appended to the key of a secret to give the path of a file holding its value,
+// e.g. CMDOD_JAMF_API_PASSWORD_FILE=/run/secrets/jamf-password
+const secretFileSuffix = "_FILE"
+
+// secrets are the keys whose values can be read from a file, see readSecretFiles
+var secrets = []string{
+	EnvJamfAPIPassword,
+	EnvJamfClientSecret,
+	EnvServerBearerToken,
+	EnvServerBearerTokenPrevious,
+	EnvAdminBearerToken,
+	EnvJamfWebhookSecret,
+	EnvJamfWebhookPassword,
+	EnvCodeStoreRedisUrl,
+	EnvWebhooks,
+	EnvAuditHMACKey,
+}
+
+// secretKey returns the secret a key sets, either directly or as the path of a file holding its value
+func secretKey(k string) (string, bool) {
+	for _, sk := range secrets {
+		if k == sk || k == sk+secretFileSuffix {
+			return sk, true
+		}
+	}
+
+	return "", false
+}
+
+// readEnvironment reads all environment variables prefixed with a given namespace over the settings from the
+// config file, and returns an Environment whose keys are set without the namespace prefix.
+// namespace is used to prevent collision with other OS env vars, but is then removed when set on Environment.
+// file is keyed without the CMDOD_ prefix, see loadConfigFile. Required keys are checked by validate, and secrets
+// are read from the files given by their _FILE variants by readSecretFiles
+func readEnvironment(namespace string, file Environment) Environment {
+	e := make(Environment)
+
+	filePrefix := strings.TrimPrefix(namespace, envNamespace)
+	for k, v := range file {
+		if strings.HasPrefix(k, filePrefix) {
+			e[strings.TrimPrefix(k, filePrefix)] = v
+		}
+	}
+
+	o := make(Environment)
 	for _, env := range os.Environ() {
 		k, v, ok := strings.Cut(env, "=")
 		if ok && strings.HasPrefix(k, namespace) {
-			e[strings.TrimPrefix(k, namespace)] = v
+			o[strings.TrimPrefix(k, namespace)] = v
 		}
 	}
 
-	for _, ek := range required() {
+	return e.overlay(o)
+}
+
+// readSecretFiles sets each secret whose _FILE variant is set to the contents of that file, without trailing newlines.
+// The _FILE variant is kept, so the file can be watched for changes. An error is returned if a file cannot be read,
+// or a secret is set both directly and with its _FILE variant. namespace is only used in error messages
+func (e Environment) readSecretFiles(namespace string) error {
+	for _, k := range secrets {
+		path := e[k+secretFileSuffix]
+		if path == "" {
+			continue
+		}
+
+		if e[k] != "" {
+			return fmt.Errorf("cannot set both %s%s and %s%s%s", namespace, k, namespace, k, secretFileSuffix)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read %s%s%s: %w", namespace, k, secretFileSuffix, err)
+		}
+
+		e[k] = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return nil
+}
+
+// secretFiles returns the paths of the files secrets are read from
+func (e Environment) secretFiles() []string {
+	var paths []string
+	for _, k := range secrets {
+		if path := e[k+secretFileSuffix]; path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// validate returns an error if not all required keys are present and set with a non-empty value.
+// namespace is only used in the error message
+func (e Environment) validate(namespace string) error {
+	for _, ek := range required(e) {
 		v, exists := e[ek]
 		if !exists {
-			err = fmt.Errorf("missing required env variable: %s%s", namespace, ek)
-			return
+			return fmt.Errorf("missing required env variable: %s%s", namespace, ek)
 		} else if v == "" {
-			err = fmt.Errorf("cannot have empty value for required variable: %s%s", namespace, ek)
+			return fmt.Errorf("cannot have empty value for required variable: %s%s", namespace, ek)
 		}
 	}
 
-	return
+	return nil
 }
 
-// required returns a list of environment variable names/keys which must be present
-func required() []string {
+// overlay returns a copy of the Environment with the keys of o set over it.
+// A secret set in o, either directly or with its _FILE variant, replaces both forms of that secret
+func (e Environment) overlay(o Environment) Environment {
+	c := make(Environment, len(e)+len(o))
+	for k, v := range e {
+		c[k] = v
+	}
+	for k := range o {
+		if sk, ok := secretKey(k); ok {
+			delete(c, sk)
+			delete(c, sk+secretFileSuffix)
+		}
+	}
+	for k, v := range o {
+		c[k] = v
+	}
+
+	return c
+}
+
+// Bool returns the value of key parsed as a boolean, or def if the key is not set or empty
+func (e Environment) Bool(key string, def bool) (bool, error) {
+	v, ok := e[key]
+	if !ok || v == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid boolean value for %s: %s", key, v)
+	}
+
+	return b, nil
+}
+
+// Port returns the value of key if it is a TCP port number, or def if the key is not set or empty
+func (e Environment) Port(key string, def string) (string, error) {
+	v, ok := e[key]
+	if !ok || v == "" {
+		return def, nil
+	}
+
+	if !validPort(v) {
+		return def, fmt.Errorf("invalid port value for %s: %s", key, v)
+	}
+
+	return v, nil
+}
+
+// validPort returns true if v is a TCP port number, from 1 to 65535
+func validPort(v string) bool {
+	p, err := strconv.Atoi(v)
+
+	return err == nil && p >= 1 && p <= 65535
+}
+
+// Int returns the value of key parsed as a non-negative integer, or def if the key is not set or empty
+func (e Environment) Int(key string, def int) (int, error) {
+	v, ok := e[key]
+	if !ok || v == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return def, fmt.Errorf("invalid integer value for %s: %s", key, v)
+	}
+
+	return i, nil
+}
+
+// Duration returns the value of key parsed as a positive time.Duration, or def if the key is not set or empty.
+// Zero is rejected, as it would disable timeouts or make tickers nil, see DurationOrZero
+func (e Environment) Duration(key string, def time.Duration) (time.Duration, error) {
+	d, err := e.DurationOrZero(key, def)
+	if err == nil && d == 0 {
+		return def, fmt.Errorf("invalid duration value for %s: %s", key, e[key])
+	}
+
+	return d, err
+}
+
+// DurationOrZero returns the value of key parsed as a time.Duration, or def if the key is not set or empty.
+// Zero is allowed, for settings where it means "none", such as command cooldowns
+func (e Environment) DurationOrZero(key string, def time.Duration) (time.Duration, error) {
+	v, ok := e[key]
+	if !ok || v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return def, fmt.Errorf("invalid duration value for %s: %s", key, v)
+	}
+
+	return d, nil
+}
+
+// required returns a list of environment variable names/keys which must be present, which depends on the
+// Jamf authentication mode. A client token is also required, either EnvServerBearerToken or EnvClientTokensFile,
+// see NewTokenRegistry
+func required(e Environment) []string {
 	req := []string{
 		EnvJamfFQDN,
-		EnvJamfAPIUser,
-		EnvJamfAPIPassword,
-		EnvServerBearerToken,
 		EnvCodeProofExtAttName,
 	}
 
+	if e[EnvJamfAuthMode] == JamfAuthModeOAuth {
+		req = append(req, EnvJamfClientId, EnvJamfClientSecret)
+	} else {
+		req = append(req, EnvJamfAPIUser, EnvJamfAPIPassword)
+	}
+
 	return req
 }
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvironmentDuration(t *testing.T) {
+	env := Environment{"ZERO": "0", "NEGATIVE": "-1s", "HOUR": "1h", "BAD": "soon", "EMPTY": ""}
+
+	tests := []struct {
+		key       string
+		want      time.Duration
+		wantErr   bool
+		orZero    time.Duration
+		orZeroErr bool
+	}{
+		{key: "HOUR", want: time.Hour, orZero: time.Hour},
+		{key: "EMPTY", want: time.Minute, orZero: time.Minute},
+		{key: "UNSET", want: time.Minute, orZero: time.Minute},
+		{key: "ZERO", wantErr: true, orZero: 0},
+		{key: "NEGATIVE", wantErr: true, orZeroErr: true},
+		{key: "BAD", wantErr: true, orZeroErr: true},
+	}
+
+	for _, tt := range tests {
+		d, err := env.Duration(tt.key, time.Minute)
+		if (err != nil) != tt.wantErr || (err == nil && d != tt.want) {
+			t.Errorf("Duration(%s) = %s, %v", tt.key, d, err)
+		}
+
+		d, err = env.DurationOrZero(tt.key, time.Minute)
+		if (err != nil) != tt.orZeroErr || (err == nil && d != tt.orZero) {
+			t.Errorf("DurationOrZero(%s) = %s, %v", tt.key, d, err)
+		}
+	}
+}
+
+func TestEnvironmentPort(t *testing.T) {
+	env := Environment{"PORT": "8443", "ZERO": "0", "HIGH": "65536", "NAME": "https", "EMPTY": ""}
+
+	for key, want := range map[string]string{"PORT": "8443", "EMPTY": "", "UNSET": ""} {
+		if p, err := env.Port(key, ""); err != nil || p != want {
+			t.Errorf("Port(%s) = '%s', %v, want '%s'", key, p, err, want)
+		}
+	}
+
+	for _, key := range []string{"ZERO", "HIGH", "NAME"} {
+		if _, err := env.Port(key, ""); err == nil {
+			t.Errorf("Port(%s): expected an error", key)
+		}
+	}
+}
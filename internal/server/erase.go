@@ -0,0 +1,72 @@
+package server
+
+import (
+	"command-on-demand/internal/jamf"
+	"fmt"
+	"os"
+)
+
+const (
+	EraseBackendClassic = "classic"
+	EraseBackendPro     = "pro"
+)
+
+// EraseConfig holds the operator configuration for EraseDevice commands
+type EraseConfig struct {
+	backend string
+	options jamf.EraseDeviceOptions
+}
+
+// NewEraseConfig builds an EraseConfig from the given Environment.
+// The Jamf Pro API options are only valid with the pro backend.
+func NewEraseConfig(env Environment) (c EraseConfig, err error) {
+	c.backend = env[EnvEraseBackend]
+	switch c.backend {
+	case "":
+		c.backend = EraseBackendClassic
+	case EraseBackendClassic, EraseBackendPro:
+	default:
+		return c, fmt.Errorf("invalid erase backend: %s", c.backend)
+	}
+
+	c.options.ObliterationBehavior = env[EnvEraseObliterationBehavior]
+	if c.options.ObliterationBehavior != "" && !jamf.ValidObliterationBehavior(c.options.ObliterationBehavior) {
+		return c, fmt.Errorf("invalid erase obliteration behavior: %s", c.options.ObliterationBehavior)
+	}
+
+	if c.options.PreserveDataPlan, err = env.Bool(EnvErasePreserveDataPlan, false); err != nil {
+		return
+	}
+
+	if c.options.DisallowProximitySetup, err = env.Bool(EnvEraseDisallowProximitySetup, false); err != nil {
+		return
+	}
+
+	if c.options.ReturnToService, err = env.Bool(EnvEraseReturnToService, false); err != nil {
+		return
+	}
+
+	if c.options.ReturnToService {
+		path := env[EnvEraseRTSWifiProfilePath]
+		if path == "" {
+			return c, fmt.Errorf("return to service requires a Wi-Fi profile: %s is not set", EnvEraseRTSWifiProfilePath)
+		}
+
+		c.options.WifiProfileData, err = os.ReadFile(path)
+		if err != nil {
+			return c, fmt.Errorf("could not read return to service Wi-Fi profile: %w", err)
+		}
+	}
+
+	if c.backend == EraseBackendClassic && c.usesProOptions() {
+		return c, fmt.Errorf("erase options require the %s erase backend", EraseBackendPro)
+	}
+
+	return c, nil
+}
+
+// usesProOptions returns true if any option only supported by the Jamf Pro API is set
+func (c EraseConfig) usesProOptions() bool {
+	o := c.options
+	return o.ObliterationBehavior != "" || o.PreserveDataPlan || o.DisallowProximitySetup || o.ReturnToService
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/logger"
+	"command-on-demand/internal/notify"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// StateStore keys of the command guard
+const (
+	guardCooldownPrefix = "cooldown:"
+	guardBudgetKey      = "budget"
+)
+
+// destructiveCommands are the commands counted against the destructive command budget
+var destructiveCommands = map[string]bool{
+	CommandEraseDevice: true,
+	CommandDeviceLock:  true,
+}
+
+// cooldownEnvKeys maps command names to the environment variable holding their per-device cooldown
+var cooldownEnvKeys = map[string]string{
+	CommandEraseDevice:    EnvCooldownErase,
+	CommandDeviceLock:     EnvCooldownLock,
+	CommandSoftwareUpdate: EnvCooldownSwupd,
+	CommandRestartDevice:  EnvCooldownRestart,
+	CommandShutDownDevice: EnvCooldownShutdown,
+}
+
+// GuardConfig holds the per-device command cooldowns and the destructive command budget.
+// A budget of 0 disables the budget, and commands without a cooldown can be sent as often as requested
+type GuardConfig struct {
+	cooldowns    map[string]time.Duration
+	budget       int
+	budgetWindow time.Duration
+}
+
+// NewGuardConfig builds a GuardConfig from the given Environment.
+// A budget requires the bolt or redis code store, as a budget held in memory would be reset by restarting the service
+func NewGuardConfig(env Environment) (c GuardConfig, err error) {
+	c.cooldowns = make(map[string]time.Duration)
+	for name, key := range cooldownEnvKeys {
+		if c.cooldowns[name], err = env.DurationOrZero(key, 0); err != nil {
+			return
+		}
+	}
+
+	if c.budget, err = env.Int(EnvDestructiveBudget, 0); err != nil {
+		return
+	}
+
+	if c.budgetWindow, err = env.Duration(EnvDestructiveBudgetWindow, time.Hour); err != nil {
+		return
+	}
+
+	if store := env[EnvCodeStore]; c.budget > 0 && (store == "" || store == CodeStoreMemory) {
+		err = fmt.Errorf("%s requires %s to be %s or %s, so the budget is not reset by a restart",
+			EnvDestructiveBudget, EnvCodeStore, CodeStoreBolt, CodeStoreRedis)
+	}
+
+	return
+}
+
+// budgetState is the stored state of the destructive command budget: the destructive commands sent in the window,
+// and the time the budget tripped, if it has
+type budgetState struct {
+	Sent      []time.Time `json:"sent,omitempty"`
+	TrippedAt *time.Time  `json:"trippedAt,omitempty"`
+}
+
+// CommandGuard enforces per-device command cooldowns and a global sliding-window budget for destructive commands.
+// When the budget is exceeded, the guard trips and refuses all destructive commands until an admin resets it.
+// State is kept in the StateStore, so it is shared between replicas when the Redis code store is used
+type CommandGuard struct {
+	config   GuardConfig
+	state    StateStore
+	notifier *notify.Dispatcher
+}
+
+// BudgetStatus is the state of the destructive command budget
+type BudgetStatus struct {
+	Budget    int        `json:"budget"`
+	Window    string     `json:"window"`
+	Used      int        `json:"used"`
+	Tripped   bool       `json:"tripped"`
+	TrippedAt *time.Time `json:"trippedAt,omitempty"`
+}
+
+// NewCommandGuard creates a new instance of CommandGuard with the given config, keeping its state in the given
+// StateStore. A budget.tripped event is sent to the notifier when the budget trips
+func NewCommandGuard(c GuardConfig, state StateStore, notifier *notify.Dispatcher) *CommandGuard {
+	return &CommandGuard{
+		config:   c,
+		state:    state,
+		notifier: notifier,
+	}
+}
+
+// reserve checks that the named command may be sent to the given UDID and, if so, records it against the cooldown
+// and budget before it is sent, so concurrent requests cannot exceed either. The returned release function must be
+// called if the command is not sent
+func (g *CommandGuard) reserve(name string, udid string) (release func(), err error) {
+	now := time.Now()
+	stamp := []byte(now.Format(time.RFC3339Nano))
+	key := guardCooldownPrefix + name + ":" + udid
+	cd := g.config.cooldowns[name]
+
+	// a cooldown key exists until the cooldown ends, and holds the time the command was sent
+	if cd > 0 {
+		err = g.state.update(key, cd, func(v []byte) ([]byte, error) {
+			if v != nil {
+				logger.Debugf("%s command to %s is in cooldown since %s", name, udid, v)
+				return nil, errors.CommandCooldown
+			}
+			return stamp, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	releaseCooldown := func() {
+		if cd <= 0 {
+			return
+		}
+		err := g.state.update(key, cd, func(v []byte) ([]byte, error) {
+			if string(v) == string(stamp) {
+				return nil, nil
+			}
+			return v, nil
+		})
+		if err != nil {
+			logger.Errorf("could not release %s cooldown for %s: %s", name, udid, err)
+		}
+	}
+
+	if !destructiveCommands[name] || g.config.budget <= 0 {
+		return releaseCooldown, nil
+	}
+
+	var tripped bool
+	err = g.state.update(guardBudgetKey, 0, func(v []byte) ([]byte, error) {
+		tripped = false
+		st, err := decodeBudgetState(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if st.TrippedAt != nil {
+			return nil, errors.BudgetExceeded
+		}
+
+		st.Sent = inWindow(st.Sent, now.Add(-g.config.budgetWindow))
+		if len(st.Sent) >= g.config.budget {
+			st.TrippedAt = &now
+			tripped = true
+		} else {
+			st.Sent = append(st.Sent, now)
+		}
+
+		return json.Marshal(st)
+	})
+	if err == nil && tripped {
+		err = errors.BudgetExceeded
+		logger.WithFields(map[string]interface{}{
+			"event":    "budget_tripped",
+			"security": true,
+			"budget":   g.config.budget,
+			"window":   g.config.budgetWindow.String(),
+			"command":  name,
+			"udid":     udid,
+		}).Error("destructive command budget exceeded, destructive commands are refused until an admin resets the budget")
+		g.notifier.Send(notify.EventBudgetTripped, map[string]interface{}{
+			"budget":    g.config.budget,
+			"window":    g.config.budgetWindow.String(),
+			"command":   name,
+			"udid":      udid,
+			"trippedAt": now,
+		})
+	}
+	if err != nil {
+		releaseCooldown()
+		return nil, err
+	}
+
+	release = func() {
+		releaseCooldown()
+
+		err := g.state.update(guardBudgetKey, 0, func(v []byte) ([]byte, error) {
+			st, err := decodeBudgetState(v)
+			if err != nil {
+				return nil, err
+			}
+
+			for i, t := range st.Sent {
+				if t.Equal(now) {
+					st.Sent = append(st.Sent[:i:i], st.Sent[i+1:]...)
+					break
+				}
+			}
+
+			return json.Marshal(st)
+		})
+		if err != nil {
+			logger.Errorf("could not release %s command to %s from the budget: %s", name, udid, err)
+		}
+	}
+
+	return release, nil
+}
+
+// status returns the current state of the destructive command budget
+func (g *CommandGuard) status() (BudgetStatus, error) {
+	v, err := g.state.get(guardBudgetKey)
+	if err != nil {
+		return BudgetStatus{}, err
+	}
+
+	st, err := decodeBudgetState(v)
+	if err != nil {
+		return BudgetStatus{}, errors.StateStoreFailed.Wrap(err)
+	}
+
+	return BudgetStatus{
+		Budget:    g.config.budget,
+		Window:    g.config.budgetWindow.String(),
+		Used:      len(inWindow(st.Sent, time.Now().Add(-g.config.budgetWindow))),
+		Tripped:   st.TrippedAt != nil,
+		TrippedAt: st.TrippedAt,
+	}, nil
+}
+
+// reset clears a tripped budget and the destructive commands counted in the current window
+func (g *CommandGuard) reset() error {
+	err := g.state.update(guardBudgetKey, 0, func([]byte) ([]byte, error) { return nil, nil })
+	if err != nil {
+		return err
+	}
+
+	logger.WithFields(map[string]interface{}{
+		"event":    "budget_reset",
+		"security": true,
+	}).Warn("destructive command budget reset by admin")
+
+	return nil
+}
+
+// decodeBudgetState returns the budgetState in the given stored value, which is empty if there is none
+func decodeBudgetState(v []byte) (st budgetState, err error) {
+	if v == nil {
+		return
+	}
+
+	err = json.Unmarshal(v, &st)
+
+	return
+}
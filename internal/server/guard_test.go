@@ -0,0 +1,135 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	e "errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func testGuardConfig() GuardConfig {
+	return GuardConfig{
+		cooldowns:    map[string]time.Duration{CommandRestartDevice: time.Hour},
+		budget:       2,
+		budgetWindow: time.Hour,
+	}
+}
+
+func TestNewGuardConfig(t *testing.T) {
+	c, err := NewGuardConfig(Environment{EnvCooldownErase: "0", EnvCooldownLock: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.cooldowns[CommandEraseDevice] != 0 || c.cooldowns[CommandDeviceLock] != time.Hour {
+		t.Errorf("unexpected cooldowns %v", c.cooldowns)
+	}
+
+	for _, env := range []Environment{
+		{EnvDestructiveBudget: "5"},
+		{EnvDestructiveBudget: "5", EnvCodeStore: CodeStoreMemory},
+		{EnvDestructiveBudget: "5", EnvCodeStore: CodeStoreRedis, EnvDestructiveBudgetWindow: "0"},
+		{EnvCooldownErase: "-1h"},
+	} {
+		if _, err = NewGuardConfig(env); err == nil {
+			t.Errorf("expected an error for %v", env)
+		}
+	}
+
+	if _, err = NewGuardConfig(Environment{EnvDestructiveBudget: "5", EnvCodeStore: CodeStoreRedis}); err != nil {
+		t.Errorf("expected a budget to be allowed with the redis code store, got %v", err)
+	}
+}
+
+func TestCommandGuardCooldown(t *testing.T) {
+	g := NewCommandGuard(testGuardConfig(), NewMemoryStateStore(), nil)
+
+	if _, err := g.reserve(CommandRestartDevice, testUdid); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := g.reserve(CommandRestartDevice, testUdid); !e.Is(err, errors.CommandCooldown) {
+		t.Errorf("expected a second command to be in cooldown, got %v", err)
+	}
+
+	if _, err := g.reserve(CommandRestartDevice, "other"); err != nil {
+		t.Errorf("expected cooldown to be per device, got %v", err)
+	}
+
+	if _, err := g.reserve(CommandShutDownDevice, testUdid); err != nil {
+		t.Errorf("expected command without a cooldown to be allowed, got %v", err)
+	}
+}
+
+func TestCommandGuardRelease(t *testing.T) {
+	g := NewCommandGuard(testGuardConfig(), NewMemoryStateStore(), nil)
+
+	// commands which are not sent do not count towards the cooldown or budget
+	for i := 0; i < 5; i++ {
+		release, err := g.reserve(CommandRestartDevice, testUdid)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+		release()
+
+		if release, err = g.reserve(CommandEraseDevice, testUdid); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+		release()
+	}
+
+	st, err := g.status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Used != 0 || st.Tripped {
+		t.Errorf("expected released commands not to be counted, got %+v", st)
+	}
+}
+
+func TestCommandGuardBudget(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := NewCommandGuard(testGuardConfig(), newTestRedisStateStore(t, mr), nil)
+	b := NewCommandGuard(testGuardConfig(), newTestRedisStateStore(t, mr), nil)
+
+	// destructive commands on different replicas count towards the same budget
+	if _, err := a.reserve(CommandEraseDevice, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.reserve(CommandDeviceLock, "two"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.reserve(CommandEraseDevice, "three"); !e.Is(err, errors.BudgetExceeded) {
+		t.Fatalf("expected the budget to trip, got %v", err)
+	}
+
+	st, err := b.status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Tripped || st.Used != 2 {
+		t.Errorf("expected a tripped budget with 2 commands used, got %+v", st)
+	}
+
+	// a tripped budget stays tripped after the window, until it is reset
+	mr.FastForward(2 * time.Hour)
+	if _, err = b.reserve(CommandDeviceLock, "four"); !e.Is(err, errors.BudgetExceeded) {
+		t.Errorf("expected the tripped budget to refuse commands, got %v", err)
+	}
+
+	if _, err = b.reserve(CommandRestartDevice, "four"); err != nil {
+		t.Errorf("expected other commands to be allowed, got %v", err)
+	}
+
+	if err = a.reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = b.reserve(CommandDeviceLock, "four"); err != nil {
+		t.Errorf("expected commands to be allowed after reset, got %v", err)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"command-on-demand/internal/errors"
 	"command-on-demand/internal/jamf"
 	"command-on-demand/internal/logger"
+	"context"
 	"encoding/json"
+	e "errors"
 	"fmt"
 	"net/http"
 
@@ -12,7 +14,9 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// CodeHandler returns a new code for the given udid
+// CodeHandler returns a new code for the given udid.
+// An intended command can be registered with the code using the command query parameter,
+// which is then sent without a further client request once Jamf reports the code, see JamfWebhookHandler
 func (s Server) CodeHandler(w http.ResponseWriter, r *http.Request) {
 	udid, err := s.checkUDID(r)
 	if err != nil {
@@ -20,11 +24,40 @@ func (s Server) CodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	code, err := s.CodeStore.NewCode(udid)
+	keys := s.Lockout.lockoutKeys(r, udid)
+	if err = s.Lockout.check(keys); err != nil {
+		logger.Error("code request rejected: ", err)
+		writeErrorResponse(w, err)
+		return
+	}
+	s.Lockout.recordCodeRequest(keys)
+
+	var command string
+	if c := r.URL.Query().Get("command"); c != "" {
+		var ok bool
+		if command, ok = commandAliases[c]; !ok {
+			writeErrorResponse(w, errors.CommandUnknown)
+			return
+		}
+
+		if err = s.checkScope(r, command); err != nil {
+			s.auditValidation(newAuditRecord(r, command, udid), jamf.Computer{}, err)
+			writeErrorResponse(w, err)
+			return
+		}
+	}
+
+	var token string
+	if t := getClientToken(r); t != nil {
+		token = t.Name
+	}
+
+	code, err := s.CodeStore.NewCode(udid, command, token)
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
+	s.notifyCodeIssued(r, udid, code)
 
 	if r.Header.Get("Accept") == "application/json" {
 		json.NewEncoder(w).Encode(struct {
@@ -37,14 +70,17 @@ func (s Server) CodeHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-// validateRequest returns a populated computer object if the udid is valid and a valid code is present in Jamf
-func (s Server) validateRequest(r *http.Request) (comp jamf.Computer, err error) {
-	udid, err := s.checkUDID(r)
-	if err != nil {
+// validateRequest returns a populated computer object if a valid code for the request's udid is present in Jamf.
+// Code mismatches and missing extension attributes count towards the lockout of the given keys, see lockoutKeys.
+// It takes values read from the request rather than the request itself, as async commands are validated after
+// the handler has returned
+func (s Server) validateRequest(rec auditRecord, keys []string) (comp jamf.Computer, err error) {
+	if err = s.Lockout.check(keys); err != nil {
+		logger.Error("request rejected: ", err)
 		return
 	}
 
-	comp, err = s.jamf.GetComputer(udid)
+	comp, err = s.jamf.GetComputer(rec.udid)
 	if err != nil {
 		logger.Error("could not get computer from Jamf: ", err)
 		return
@@ -53,6 +89,10 @@ func (s Server) validateRequest(r *http.Request) (comp jamf.Computer, err error)
 	err = s.checkCode(comp)
 	if err != nil {
 		logger.Error("code match failed: ", err)
+		if e.Is(err, errors.CodeMismatch) || e.Is(err, errors.ExtAttrNotFound) {
+			s.Lockout.recordFailure(keys, err)
+			s.notifyCodeMismatch(rec, comp, err)
+		}
 		return
 	}
 
@@ -78,14 +118,19 @@ func (s Server) checkUDID(r *http.Request) (string, error) {
 
 // checkCode returns an error if the code in Jamf does not match the code in the request or if the code has expired
 // an error is also returned if the extension attribute is not present on the computer record
+// the code is consumed regardless of the outcome, so it can only be used once
 func (s Server) checkCode(comp jamf.Computer) (err error) {
-	code, err := s.CodeStore.getCode(comp.Udid)
-	defer s.CodeStore.ExpireCode(comp.Udid)
+	code, err := s.CodeStore.consumeCode(comp.Udid)
 	if err != nil {
 		return
 	}
 
-	eaName := s.env[EnvCodeProofExtAttName]
+	return s.matchCode(comp, code)
+}
+
+// matchCode returns an error if the value of the code proof extension attribute does not match the given code
+func (s Server) matchCode(comp jamf.Computer, code *Code) (err error) {
+	eaName := s.env()[EnvCodeProofExtAttName]
 	eaVal, err := comp.GetExtensionAttribute(eaName)
 	if err != nil {
 		logger.Debugf("could not get extension attribute: %s", eaName)
@@ -101,46 +146,214 @@ func (s Server) checkCode(comp jamf.Computer) (err error) {
 	return
 }
 
-// EraseHandler sends an EraseDevice command to the computer specified in the request
+// EraseHandler sends an EraseDevice command to the computer specified in the request,
+// using the configured erase backend
 func (s Server) EraseHandler(w http.ResponseWriter, r *http.Request) {
-	comp, err := s.validateRequest(r)
+	s.sendCommand(w, r, CommandEraseDevice, s.eraseDeviceBuilder())
+}
+
+// DeviceLockHandler sends a DeviceLock command to the computer specified in the request.
+// The PIN is not returned to the caller; it is escrowed for admins, see PinLookupHandler.
+func (s Server) DeviceLockHandler(w http.ResponseWriter, r *http.Request) {
+	var params deviceLockRequest
+	if err := decodeBody(w, r, &params); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	s.sendCommand(w, r, CommandDeviceLock, s.deviceLockBuilder(params))
+}
+
+// SoftwareUpdateHandler sends a Software Update command to the computer specified in the request.
+// The command parameters are read from the request body; the body is validated before the code is checked
+// so a malformed body does not consume the code. The parameters are then bounded by the software update policy.
+func (s Server) SoftwareUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	params := newSoftwareUpdateRequest()
+	if err := decodeBody(w, r, &params); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	if _, err := params.config(); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	s.sendCommand(w, r, CommandSoftwareUpdate, s.softwareUpdateBuilder(params))
+}
+
+// RestartDeviceHandler sends a RestartDevice command to the computer specified in the request
+func (s Server) RestartDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	s.sendCommand(w, r, CommandRestartDevice, s.restartDeviceBuilder())
+}
+
+// ShutDownDeviceHandler sends a ShutDownDevice command to the computer specified in the request
+func (s Server) ShutDownDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	s.sendCommand(w, r, CommandShutDownDevice, s.shutDownDeviceBuilder())
+}
+
+// JobHandler returns the Job with the id given in the request, if it was created with the request's client token
+func (s Server) JobHandler(w http.ResponseWriter, r *http.Request) {
+	var token string
+	if t := getClientToken(r); t != nil {
+		token = t.Name
+	}
+
+	job, err := s.JobStore.getJob(mux.Vars(r)["id"], token)
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
 
-	logger.Debug("sending EraseDevice command with PIN: ", eraseDevicePin)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&job)
+}
 
-	cmd := jamf.NewEraseDeviceCommand(comp, eraseDevicePin)
-	err = s.jamf.SendCommand(cmd)
+// BudgetHandler returns the state of the destructive command budget
+func (s Server) BudgetHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := s.Guard.status()
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
 
-	logger.Info("EraseDevice command sent successfully")
-	writeResponse(w, http.StatusCreated, "EraseDevice command sent. Prepare thyself!")
-	return
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&status)
 }
 
-// SoftwareUpdateHandler sends a Software Update command to the computer specified in the request
-func (s Server) SoftwareUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	comp, err := s.validateRequest(r)
+// BudgetResetHandler resets the destructive command budget, allowing destructive commands again after it has tripped
+func (s Server) BudgetResetHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.Guard.reset(); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, "destructive command budget reset")
+}
+
+// CodesHandler lists the UDIDs with outstanding codes and their expiry, without the code values
+func (s Server) CodesHandler(w http.ResponseWriter, r *http.Request) {
+	codes, err := s.CodeStore.ListCodes()
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
 
-	logger.Debug("sending Software Update command with forceInstallLatest preset")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&codes)
+}
+
+// CodeLookupHandler returns the expiry of the outstanding code for the UDID given in the request, without its value
+func (s Server) CodeLookupHandler(w http.ResponseWriter, r *http.Request) {
+	udid := mux.Vars(r)["udid"]
 
-	cmd := jamf.NewSoftwareUpdateCommand(comp, jamf.ForceInstallLatest)
-	err = s.jamf.SendCommand(cmd)
+	code, err := s.CodeStore.getCode(udid)
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
 
-	logger.Info("Software Update command sent successfully")
-	writeResponse(w, http.StatusCreated, "Software Update command sent")
-	return
+	info := code.info(udid)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&info)
+}
+
+// CodeRevokeHandler revokes the outstanding code for the UDID given in the request,
+// so the device must request a new code before a command can be sent
+func (s Server) CodeRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	udid := mux.Vars(r)["udid"]
+
+	if err := s.CodeStore.RevokeCode(udid); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	logger.WithFields(map[string]interface{}{
+		"event":    "code_revoked",
+		"security": true,
+		"tenant":   s.tenant,
+		"udid":     udid,
+	}).Warn("code revoked by admin")
+
+	writeResponse(w, http.StatusOK, "code revoked")
+}
+
+// CodesFlushHandler revokes every outstanding code
+func (s Server) CodesFlushHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := s.CodeStore.FlushCodes()
+	if err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	logger.WithFields(map[string]interface{}{
+		"event":    "codes_flushed",
+		"security": true,
+		"tenant":   s.tenant,
+		"count":    n,
+	}).Warn("all codes revoked by admin")
+
+	writeResponse(w, http.StatusOK, fmt.Sprintf("%d codes revoked", n))
+}
+
+// PinLookupHandler returns the last escrowed PIN for the UDID or serial number given in the request.
+// The PinStore is checked first, falling back to the PIN escrow extension attribute in Jamf when configured.
+func (s Server) PinLookupHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	escrowed, ok := s.PinStore.get(id)
+	if !ok {
+		ctx, cancel := context.WithTimeout(r.Context(), JamfDeadline)
+		defer cancel()
+		s.jamf = s.jamf.WithContext(ctx)
+
+		var err error
+		escrowed, err = s.lookupEscrowedPin(id)
+		if err != nil {
+			writeErrorResponse(w, err)
+			return
+		}
+	}
+
+	logger.WithFields(map[string]interface{}{
+		"event":  "pin_lookup",
+		"udid":   escrowed.Udid,
+		"serial": escrowed.SerialNumber,
+	}).Info("escrowed PIN retrieved by admin")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&escrowed)
+}
+
+// lookupEscrowedPin reads the escrowed PIN for the given UDID or serial number from the PIN escrow extension attribute
+func (s Server) lookupEscrowedPin(id string) (escrowed EscrowedPin, err error) {
+	eaName := s.env()[EnvPinEscrowExtAttName]
+	if eaName == "" {
+		return escrowed, errors.PinNotFound
+	}
+
+	var comp jamf.Computer
+	if _, uErr := uuid.Parse(id); uErr == nil {
+		comp, err = s.jamf.GetComputer(id)
+	} else {
+		comp, err = s.jamf.GetComputerBySerial(id)
+	}
+
+	if err != nil {
+		logger.Error("could not get computer from Jamf: ", err)
+		return
+	}
+
+	pin, err := comp.GetExtensionAttribute(eaName)
+	if err != nil || pin == "" {
+		return escrowed, errors.PinNotFound
+	}
+
+	escrowed = EscrowedPin{
+		Udid:         comp.Udid,
+		SerialNumber: comp.SerialNumber,
+		ComputerId:   comp.Id,
+		Pin:          pin,
+	}
+
+	return escrowed, nil
 }
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/jamf"
+	"command-on-demand/internal/logger"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job states
+const (
+	JobStateValidating   = "validating"
+	JobStateSent         = "sent"
+	JobStateNotNow       = "notnow"
+	JobStateAcknowledged = "acknowledged"
+	JobStateFailed       = "failed"
+)
+
+// jobRetention is how long a job is kept after its last update
+const jobRetention = 24 * time.Hour
+
+// Job is the record of a single command invocation, which can only be read with the client token which created it.
+// Once sent, the job is tracked against the device's MDM command history until the command completes, see TrackCommands
+type Job struct {
+	Id       string     `json:"id"`
+	Command  string     `json:"command"`
+	Udid     string     `json:"udid"`
+	State    string     `json:"state"`
+	MdmState string     `json:"mdmState,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Updated  time.Time  `json:"updated"`
+	Sent     *time.Time `json:"sent,omitempty"`
+
+	token          string
+	computerId     int
+	managementId   string
+	mdmCommandType string
+	tracking       bool
+	warned         bool
+}
+
+// JobStore stores Job objects and provides a mutex for safe concurrent access.
+// Jobs are only held in memory, so they are lost on restart and are not shared between instances of the service
+type JobStore struct {
+	sync.RWMutex
+	jobs map[string]Job
+}
+
+// NewJobStore creates a new instance of JobStore with an empty map of jobs
+func NewJobStore() *JobStore {
+	return &JobStore{
+		jobs: make(map[string]Job),
+	}
+}
+
+// NewJob creates a new Job in the validating state for the named command and UDID, requested with the named
+// client token, and stores it in the JobStore
+func (j *JobStore) NewJob(command string, udid string, token string) Job {
+	now := time.Now()
+	job := Job{
+		Id:      uuid.NewString(),
+		Command: command,
+		Udid:    udid,
+		State:   JobStateValidating,
+		Created: now,
+		Updated: now,
+		token:   token,
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	j.jobs[job.Id] = job
+
+	logger.Debugf("created job %s for %s command to %s", job.Id, command, udid)
+
+	return job
+}
+
+// setState updates the state of the job with the given id. err is recorded against the job when not nil
+func (j *JobStore) setState(id string, state string, err error) {
+	j.updateJob(id, func(job *Job) {
+		job.State = state
+		if err != nil {
+			_, job.Error, _ = classifyError(err)
+		}
+	})
+
+	logger.Debugf("job %s is now %s", id, state)
+}
+
+// setSent moves the job with the given id to the sent state and starts tracking the command's delivery
+func (j *JobStore) setSent(id string, comp jamf.Computer, mdmCommandType string) {
+	j.updateJob(id, func(job *Job) {
+		now := time.Now()
+		job.State = JobStateSent
+		job.Sent = &now
+		job.computerId = comp.Id
+		job.mdmCommandType = mdmCommandType
+		job.tracking = true
+	})
+
+	logger.Debugf("job %s is now %s", id, JobStateSent)
+}
+
+// updateJob calls fn with the job with the given id while holding the lock, so it can be updated safely
+func (j *JobStore) updateJob(id string, fn func(job *Job)) {
+	j.Lock()
+	defer j.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return
+	}
+
+	fn(&job)
+	job.Updated = time.Now()
+	j.jobs[id] = job
+}
+
+// tracked returns the jobs whose command delivery is still being tracked
+func (j *JobStore) tracked() []Job {
+	j.RLock()
+	defer j.RUnlock()
+
+	var jobs []Job
+	for _, job := range j.jobs {
+		if job.tracking {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs
+}
+
+// getJob returns the Job with the given id, created with the named client token.
+// A job created with another token is not found, so job ids cannot be used to read other clients' jobs
+func (j *JobStore) getJob(id string, token string) (Job, error) {
+	j.RLock()
+	defer j.RUnlock()
+
+	job, ok := j.jobs[id]
+	if !ok || job.token != token {
+		return Job{}, errors.JobNotFound
+	}
+
+	return job, nil
+}
+
+// Prune is a goroutine that runs every given interval and removes jobs which have not been updated within the
+// retention period from the JobStore. Jobs which are still being tracked are kept
+func (j *JobStore) Prune(every time.Duration) {
+	for range time.Tick(every) {
+		j.Lock()
+		for id, job := range j.jobs {
+			if !job.tracking && time.Since(job.Updated) > jobRetention {
+				delete(j.jobs, id)
+				logger.Debugf("pruned job %s", id)
+			}
+		}
+		j.Unlock()
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestJobHandlerToken(t *testing.T) {
+	s, _ := newTestWebhookServer(t, &fakeJamf{})
+	job := s.JobStore.NewJob(CommandRestartDevice, testUdid, "helpdesk")
+
+	tests := []struct {
+		token  *ClientToken
+		status int
+	}{
+		{token: &ClientToken{Name: "helpdesk"}, status: http.StatusOK},
+		{token: &ClientToken{Name: "other"}, status: errors.JobNotFound.Status},
+		{token: nil, status: errors.JobNotFound.Status},
+	}
+
+	for _, tt := range tests {
+		r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"id": job.Id})
+		if tt.token != nil {
+			r = withClientToken(r, tt.token)
+		}
+
+		w := httptest.NewRecorder()
+		s.JobHandler(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("token %+v: got status %d, want %d", tt.token, w.Code, tt.status)
+			continue
+		}
+
+		var got Job
+		if tt.status == http.StatusOK && (json.NewDecoder(w.Body).Decode(&got) != nil || got.Id != job.Id) {
+			t.Errorf("token %+v: expected job %s, got %+v", tt.token, job.Id, got)
+		}
+	}
+}
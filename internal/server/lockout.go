@@ -0,0 +1,248 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/logger"
+	"command-on-demand/internal/notify"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// lockoutKeyPrefix is prepended to lockout keys in the StateStore
+const lockoutKeyPrefix = "lockout:"
+
+// LockoutConfig holds the thresholds for locking out UDIDs and client IPs after repeated failures or code requests.
+// A threshold of 0 disables that check
+type LockoutConfig struct {
+	failureThreshold     int
+	codeRequestThreshold int
+	window               time.Duration
+	cooldown             time.Duration
+	trustProxyHeaders    bool
+}
+
+// NewLockoutConfig builds a LockoutConfig from the given Environment
+func NewLockoutConfig(env Environment) (c LockoutConfig, err error) {
+	if c.failureThreshold, err = env.Int(EnvLockoutFailureThreshold, 5); err != nil {
+		return
+	}
+
+	if c.codeRequestThreshold, err = env.Int(EnvLockoutCodeRequestThreshold, 20); err != nil {
+		return
+	}
+
+	if c.window, err = env.Duration(EnvLockoutWindow, 15*time.Minute); err != nil {
+		return
+	}
+
+	if c.cooldown, err = env.Duration(EnvLockoutCooldown, time.Hour); err != nil {
+		return
+	}
+
+	if c.trustProxyHeaders, err = env.Bool(EnvTrustProxyHeaders, false); err != nil {
+		return
+	}
+
+	if c.enabled() && !c.trustProxyHeaders {
+		logger.Warnf("lockout is enabled without %s, so clients behind a proxy or load balancer share its IP address "+
+			"and can lock each other out", EnvTrustProxyHeaders)
+	}
+
+	return
+}
+
+// enabled returns true if either lockout threshold is set
+func (c LockoutConfig) enabled() bool {
+	return c.failureThreshold > 0 || c.codeRequestThreshold > 0
+}
+
+// lockoutState is the stored state of a lockout key: its recent events, and the time it is locked out until
+type lockoutState struct {
+	Failures    []time.Time `json:"failures,omitempty"`
+	Requests    []time.Time `json:"requests,omitempty"`
+	LockedUntil time.Time   `json:"lockedUntil,omitempty"`
+}
+
+// Lockout tracks failed code proofs and code requests per key (a UDID or client IP) within a sliding window,
+// and locks out keys which exceed the thresholds for the cooldown period.
+// State is kept in the StateStore, so it is shared between replicas when the Redis code store is used
+type Lockout struct {
+	config   LockoutConfig
+	state    StateStore
+	notifier *notify.Dispatcher
+}
+
+// NewLockout creates a new instance of Lockout with the given config, keeping its state in the given StateStore.
+// A lockout.triggered event is sent to the notifier when a key is locked out
+func NewLockout(c LockoutConfig, state StateStore, notifier *notify.Dispatcher) *Lockout {
+	return &Lockout{
+		config:   c,
+		state:    state,
+		notifier: notifier,
+	}
+}
+
+// lockoutKeys returns the keys used to track the given UDID and the client IP of the request
+func (l *Lockout) lockoutKeys(r *http.Request, udid string) []string {
+	return []string{udidLockoutKey(udid), "ip:" + clientIP(r, l.config.trustProxyHeaders)}
+}
+
+// udidLockoutKey returns the key used to track the given UDID.
+// It is the only key of code proofs completed by the Jamf webhook, whose client IP is Jamf's
+func udidLockoutKey(udid string) string {
+	return "udid:" + udid
+}
+
+// check returns errors.LockedOut if any of the given keys are locked out.
+// Requests are rejected if the lockout state cannot be read
+func (l *Lockout) check(keys []string) error {
+	if !l.config.enabled() {
+		return nil
+	}
+
+	now := time.Now()
+	for _, k := range keys {
+		st, err := l.load(k)
+		if err != nil {
+			return err
+		}
+
+		if now.Before(st.LockedUntil) {
+			logger.Debugf("%s is locked out until %s", k, st.LockedUntil)
+			return errors.LockedOut
+		}
+	}
+
+	return nil
+}
+
+// recordFailure records a failed code proof against the given keys, locking out any which exceed the threshold
+func (l *Lockout) recordFailure(keys []string, reason error) {
+	l.record(func(st *lockoutState) *[]time.Time { return &st.Failures }, l.config.failureThreshold, keys,
+		"code proof failures", reason)
+}
+
+// recordCodeRequest records a code request against the given keys, locking out any which exceed the threshold
+func (l *Lockout) recordCodeRequest(keys []string) {
+	l.record(func(st *lockoutState) *[]time.Time { return &st.Requests }, l.config.codeRequestThreshold, keys,
+		"code requests", nil)
+}
+
+// record adds an event to the events selected from each key's state, and locks out keys with threshold or more
+// events in the window
+func (l *Lockout) record(events func(st *lockoutState) *[]time.Time, threshold int, keys []string, kind string,
+	reason error) {
+	if threshold <= 0 {
+		return
+	}
+
+	for _, k := range keys {
+		var lockedUntil time.Time
+		err := l.state.update(lockoutKeyPrefix+k, l.config.window+l.config.cooldown, func(v []byte) ([]byte, error) {
+			lockedUntil = time.Time{}
+			st, err := decodeLockoutState(v)
+			if err != nil {
+				return nil, err
+			}
+
+			now := time.Now()
+			ev := events(&st)
+			*ev = append(inWindow(*ev, now.Add(-l.config.window)), now)
+			if len(*ev) >= threshold {
+				st.LockedUntil = now.Add(l.config.cooldown)
+				lockedUntil = st.LockedUntil
+				*ev = nil
+			}
+
+			return json.Marshal(st)
+		})
+		if err != nil {
+			logger.Errorf("could not record %s for %s: %s", kind, k, err)
+			continue
+		}
+
+		if lockedUntil.IsZero() {
+			continue
+		}
+
+		fields := map[string]interface{}{
+			"event":       "lockout",
+			"security":    true,
+			"key":         k,
+			"kind":        kind,
+			"threshold":   threshold,
+			"window":      l.config.window.String(),
+			"lockedUntil": lockedUntil,
+		}
+		if reason != nil {
+			fields["reason"] = reason.Error()
+		}
+		logger.WithFields(fields).Warn("lockout triggered")
+
+		data := make(map[string]interface{})
+		for f, v := range fields {
+			if f != "event" && f != "security" {
+				data[f] = v
+			}
+		}
+		l.notifier.Send(notify.EventLockoutTriggered, data)
+	}
+}
+
+// load returns the stored state of the given key, which is empty if there is none
+func (l *Lockout) load(key string) (lockoutState, error) {
+	v, err := l.state.get(lockoutKeyPrefix + key)
+	if err != nil {
+		return lockoutState{}, err
+	}
+
+	st, err := decodeLockoutState(v)
+	if err != nil {
+		return lockoutState{}, errors.StateStoreFailed.Wrap(err)
+	}
+
+	return st, nil
+}
+
+// decodeLockoutState returns the lockoutState in the given stored value, which is empty if there is none
+func decodeLockoutState(v []byte) (st lockoutState, err error) {
+	if v == nil {
+		return
+	}
+
+	err = json.Unmarshal(v, &st)
+
+	return
+}
+
+// inWindow returns the times which are after the given start, which must be in ascending order
+func inWindow(ts []time.Time, start time.Time) []time.Time {
+	for i, t := range ts {
+		if t.After(start) {
+			return ts[i:]
+		}
+	}
+
+	return nil
+}
+
+// clientIP returns the IP address of the client making the request.
+// When proxy headers are trusted, the last address in X-Forwarded-For (the one added by the proxy) is used
+func clientIP(r *http.Request, trustProxyHeaders bool) string {
+	if trustProxyHeaders {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
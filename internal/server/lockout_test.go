@@ -0,0 +1,154 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	e "errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisStateStore returns a RedisStateStore backed by the given in-process fake Redis server
+func newTestRedisStateStore(t *testing.T, mr *miniredis.Miniredis) *RedisStateStore {
+	t.Helper()
+
+	c, err := NewRedisStateStore("redis://"+mr.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.client.Close() })
+
+	return c
+}
+
+func testLockoutConfig() LockoutConfig {
+	return LockoutConfig{failureThreshold: 3, codeRequestThreshold: 5, window: time.Minute, cooldown: time.Hour}
+}
+
+func TestNewLockoutConfigDefaults(t *testing.T) {
+	c, err := NewLockoutConfig(Environment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.failureThreshold != 5 || c.codeRequestThreshold != 20 {
+		t.Errorf("expected lockout to be enabled by default, got %+v", c)
+	}
+}
+
+func TestNewLockoutConfigDisabled(t *testing.T) {
+	c, err := NewLockoutConfig(Environment{EnvLockoutFailureThreshold: "0", EnvLockoutCodeRequestThreshold: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.enabled() {
+		t.Errorf("expected thresholds of 0 to disable lockout, got %+v", c)
+	}
+
+	l := NewLockout(c, NewMemoryStateStore(), nil)
+	keys := []string{"udid:" + testUdid}
+	for i := 0; i < 100; i++ {
+		l.recordFailure(keys, errors.CodeMismatch)
+		l.recordCodeRequest(keys)
+	}
+
+	if err = l.check(keys); err != nil {
+		t.Errorf("expected disabled lockout not to reject requests, got %v", err)
+	}
+}
+
+func TestLockoutFailureThreshold(t *testing.T) {
+	l := NewLockout(testLockoutConfig(), NewMemoryStateStore(), nil)
+	keys := []string{"udid:" + testUdid, "ip:192.0.2.1"}
+
+	for i := 0; i < 2; i++ {
+		l.recordFailure(keys, errors.CodeMismatch)
+	}
+
+	if err := l.check(keys); err != nil {
+		t.Fatalf("expected no lockout below threshold, got %v", err)
+	}
+
+	l.recordFailure(keys, errors.CodeMismatch)
+
+	for _, k := range keys {
+		if err := l.check([]string{k}); !e.Is(err, errors.LockedOut) {
+			t.Errorf("expected %s to be locked out, got %v", k, err)
+		}
+	}
+
+	if err := l.check([]string{"udid:other", "ip:192.0.2.2"}); err != nil {
+		t.Errorf("expected other keys not to be locked out, got %v", err)
+	}
+}
+
+func TestLockoutCodeRequestThreshold(t *testing.T) {
+	l := NewLockout(testLockoutConfig(), NewMemoryStateStore(), nil)
+	keys := []string{"ip:192.0.2.1"}
+
+	for i := 0; i < 5; i++ {
+		if err := l.check(keys); err != nil {
+			t.Fatalf("request %d: unexpected lockout: %v", i+1, err)
+		}
+		l.recordCodeRequest(keys)
+	}
+
+	if err := l.check(keys); !e.Is(err, errors.LockedOut) {
+		t.Errorf("expected lockout after threshold code requests, got %v", err)
+	}
+}
+
+func TestLockoutWindow(t *testing.T) {
+	c := testLockoutConfig()
+	c.window = 50 * time.Millisecond
+	l := NewLockout(c, NewMemoryStateStore(), nil)
+	keys := []string{"udid:" + testUdid}
+
+	l.recordFailure(keys, errors.CodeMismatch)
+	l.recordFailure(keys, errors.CodeMismatch)
+	time.Sleep(2 * c.window)
+	l.recordFailure(keys, errors.CodeMismatch)
+
+	if err := l.check(keys); err != nil {
+		t.Errorf("expected failures outside the window not to count, got %v", err)
+	}
+}
+
+func TestLockoutSharedBetweenReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := NewLockout(testLockoutConfig(), newTestRedisStateStore(t, mr), nil)
+	b := NewLockout(testLockoutConfig(), newTestRedisStateStore(t, mr), nil)
+	keys := []string{"udid:" + testUdid}
+
+	// failures recorded on different replicas count towards the same threshold
+	a.recordFailure(keys, errors.CodeMismatch)
+	b.recordFailure(keys, errors.CodeMismatch)
+	a.recordFailure(keys, errors.CodeMismatch)
+
+	if err := b.check(keys); !e.Is(err, errors.LockedOut) {
+		t.Errorf("expected lockout on another replica, got %v", err)
+	}
+
+	mr.FastForward(time.Minute + time.Hour + time.Second)
+
+	if err := a.check(keys); err != nil {
+		t.Errorf("expected lockout state to expire after the cooldown, got %v", err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:51234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9")
+
+	if got := clientIP(r, false); got != "10.0.0.1" {
+		t.Errorf("clientIP without trusted proxy headers = %s, want 10.0.0.1", got)
+	}
+
+	if got := clientIP(r, true); got != "203.0.113.9" {
+		t.Errorf("clientIP with trusted proxy headers = %s, want 203.0.113.9", got)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"command-on-demand/internal/errors"
 	"command-on-demand/internal/logger"
 	"context"
-	"crypto/subtle"
 	"net/http"
 	"strings"
 
@@ -44,30 +43,79 @@ func MiddlewareLogging(next http.Handler) http.Handler {
 	})
 }
 
+// MiddlewareBearerAuth authenticates client requests with a token from the TokenRegistry.
+// The matched token is attached to the request context, so handlers can check its scope
 func (s Server) MiddlewareBearerAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rId := getRequestId(r)
 
-		t := r.Header.Get("Authorization")
-
-		if !strings.HasPrefix(t, "Bearer ") {
-			logger.WithRequest(rId, r).Error(errors.BadToken)
-			writeErrorResponse(w, errors.BadToken)
+		t, gen, err := s.cfg().tokens.authenticate(r)
+		if err != nil {
+			l := logger.WithRequest(rId, r).WithField("tenant", s.tenant)
+			if t != nil {
+				l = l.WithField("token", t.Name).WithField("tokenGeneration", gen)
+			}
+			l.Error(err)
+			writeErrorResponse(w, err)
 			return
 		}
 
-		// convert to []byte outside of CTC as these are not constant time ops
-		bt := []byte(strings.TrimPrefix(t, "Bearer "))
-		bst := []byte(s.token())
+		logger.WithRequest(rId, r).WithField("tenant", s.tenant).WithField("token", t.Name).WithField("tokenGeneration", gen).
+			Info("token authentication successful")
+		next.ServeHTTP(w, withClientToken(r, t))
+	})
+}
+
+// MiddlewareAdminAuth authenticates admin requests with the admin bearer token.
+// Admin endpoints are obfuscated in the same way as unknown paths when no admin token is configured
+func (s Server) MiddlewareAdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rId := getRequestId(r)
 
-		match := subtle.ConstantTimeCompare(bt, bst)
-		if match != 1 {
-			logger.WithRequest(rId, r).Error(errors.InvalidToken)
-			writeErrorResponse(w, errors.InvalidToken)
+		if s.adminToken() == "" {
+			w.WriteHeader(http.StatusForbidden)
 			return
 		}
 
-		logger.WithRequest(rId, r).Info("token authentication successful")
+		if err := checkBearer(r, s.adminToken()); err != nil {
+			logger.WithRequest(rId, r).Error("admin ", err)
+			writeErrorResponse(w, err)
+			return
+		}
+
+		logger.WithRequest(rId, r).Info("admin token authentication successful")
 		next.ServeHTTP(w, r)
 	})
 }
+
+// checkBearer returns an error if the request does not carry the given bearer token,
+// which may be given as plaintext or as "sha256:<hex digest>"
+func checkBearer(r *http.Request, token string) error {
+	bt, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+
+	secret, err := parseTokenSecret(token)
+	if err != nil {
+		logger.Error("configured token is not valid: ", err)
+		return errors.InvalidToken
+	}
+
+	if !secret.matches(bt) {
+		return errors.InvalidToken
+	}
+
+	return nil
+}
+
+// bearerToken returns the bearer token from the Authorization header of the request
+func bearerToken(r *http.Request) ([]byte, error) {
+	t := r.Header.Get("Authorization")
+
+	if !strings.HasPrefix(t, "Bearer ") {
+		return nil, errors.BadToken
+	}
+
+	return []byte(strings.TrimPrefix(t, "Bearer ")), nil
+}
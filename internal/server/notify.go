@@ -0,0 +1,130 @@
+package server
+
+import (
+	"command-on-demand/internal/jamf"
+	"command-on-demand/internal/notify"
+	"fmt"
+	"net/http"
+)
+
+// newWebhookTargets returns the outbound webhook targets given as JSON in EnvWebhooks
+func newWebhookTargets(env Environment) ([]notify.Target, error) {
+	v := env[EnvWebhooks]
+	if v == "" {
+		return nil, nil
+	}
+
+	targets, err := notify.ParseTargets([]byte(v))
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", EnvWebhooks, err)
+	}
+
+	return targets, nil
+}
+
+// newNotifier builds the outbound webhook Dispatcher for the named tenant from the given Environment.
+// The Dispatcher is created without targets when none are configured, so targets can be added on reload
+func newNotifier(env Environment, tenant string, targets []notify.Target) (*notify.Dispatcher, error) {
+	o := notify.DefaultOptions()
+
+	var err error
+	if o.QueueSize, err = env.Int(EnvWebhookQueueSize, o.QueueSize); err != nil {
+		return nil, err
+	}
+
+	if o.Workers, err = env.Int(EnvWebhookWorkers, o.Workers); err != nil {
+		return nil, err
+	}
+
+	if o.MaxAttempts, err = env.Int(EnvWebhookMaxAttempts, o.MaxAttempts); err != nil {
+		return nil, err
+	}
+
+	if o.RetryBaseDelay, err = env.Duration(EnvWebhookRetryBaseDelay, o.RetryBaseDelay); err != nil {
+		return nil, err
+	}
+
+	if o.RetryMaxDelay, err = env.Duration(EnvWebhookRetryMaxDelay, o.RetryMaxDelay); err != nil {
+		return nil, err
+	}
+
+	if o.Timeout, err = env.Duration(EnvWebhookTimeout, o.Timeout); err != nil {
+		return nil, err
+	}
+
+	o.DeadLetterPath = env[EnvWebhookDeadLetterPath]
+
+	return notify.NewDispatcher(tenant, targets, o)
+}
+
+// notifyCodeIssued sends a code.issued event for a code generated by a client request. The code's value is not sent
+func (s Server) notifyCodeIssued(r *http.Request, udid string, code *Code) {
+	data := map[string]interface{}{
+		"udid":      udid,
+		"expires":   code.expires,
+		"requestId": getRequestId(r),
+	}
+
+	if code.command != "" {
+		data["command"] = code.command
+	}
+
+	if t := getClientToken(r); t != nil {
+		data["token"] = t.Name
+	}
+
+	s.Notifier.Send(notify.EventCodeIssued, data)
+}
+
+// notifyCodeMismatch sends a code.mismatch event for a request, or a Jamf webhook, whose code did not match the code
+// proof extension attribute, or whose computer has no such attribute
+func (s Server) notifyCodeMismatch(rec auditRecord, comp jamf.Computer, mErr error) {
+	data := map[string]interface{}{
+		"udid":       rec.udid,
+		"serial":     comp.SerialNumber,
+		"computerId": comp.Id,
+		"reason":     mErr.Error(),
+		"requestId":  rec.requestId,
+	}
+
+	if rec.token != "" {
+		data["token"] = rec.token
+	}
+
+	if rec.source != "" {
+		data["source"] = rec.source
+	}
+
+	s.Notifier.Send(notify.EventCodeMismatch, data)
+}
+
+// notifyCommand sends a command.sent or command.failed event for the result of sending a command.
+// token is the client token which requested the command, or its code when the command was completed by a Jamf webhook.
+// cmd is nil if the command was not built
+func (s Server) notifyCommand(rec auditRecord, jobId string, comp jamf.Computer, cmd jamf.Commander, sErr error) {
+	data := map[string]interface{}{
+		"command":    rec.command,
+		"udid":       rec.udid,
+		"serial":     comp.SerialNumber,
+		"computerId": comp.Id,
+		"token":      rec.token,
+		"requestId":  rec.requestId,
+		"jobId":      jobId,
+	}
+
+	if rec.source != "" {
+		data["source"] = rec.source
+	}
+
+	if cmd != nil {
+		data["params"] = cmd.Parameters()
+	}
+
+	if sErr != nil {
+		data["error"] = sErr.Error()
+		s.Notifier.Send(notify.EventCommandFailed, data)
+		return
+	}
+
+	s.Notifier.Send(notify.EventCommandSent, data)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/jamf"
+	"command-on-demand/internal/logger"
+	"command-on-demand/internal/util"
+	"context"
+	"sync"
+	"time"
+)
+
+// EscrowedPin is the record of a PIN sent to a computer with an EraseDevice or DeviceLock command
+type EscrowedPin struct {
+	Udid         string    `json:"udid"`
+	SerialNumber string    `json:"serialNumber"`
+	ComputerId   int       `json:"computerId"`
+	Command      string    `json:"command"`
+	Pin          string    `json:"pin"`
+	Escrowed     time.Time `json:"escrowed"`
+}
+
+// PinStore holds the last escrowed PIN for each UDID and provides a mutex for safe concurrent access
+type PinStore struct {
+	sync.RWMutex
+	pins map[string]EscrowedPin
+}
+
+// NewPinStore creates a new instance of PinStore with an empty map of PINs
+func NewPinStore() *PinStore {
+	return &PinStore{
+		pins: make(map[string]EscrowedPin),
+	}
+}
+
+// put stores the given EscrowedPin, replacing any previous PIN for the same UDID
+func (p *PinStore) put(e EscrowedPin) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.pins[e.Udid] = e
+}
+
+// get returns the EscrowedPin for the given UDID or serial number, if present
+func (p *PinStore) get(id string) (EscrowedPin, bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	if e, ok := p.pins[id]; ok {
+		return e, true
+	}
+
+	for _, e := range p.pins {
+		if e.SerialNumber == id {
+			return e, true
+		}
+	}
+
+	return EscrowedPin{}, false
+}
+
+// pinCommander is implemented by commands which set a PIN on the computer, whose PIN is escrowed once sent
+type pinCommander interface {
+	Pin() string
+}
+
+// newPin generates a new random PIN for an EraseDevice or DeviceLock command
+func newPin() (string, error) {
+	pin, err := util.RandomSixDigitPin()
+	if err != nil {
+		return "", errors.PinGenFailed.Wrap(err)
+	}
+
+	return pin, nil
+}
+
+// escrowPin escrows the PIN of the named command once it has been sent to the computer, so a failed send does not
+// replace the PIN of an earlier command. The PIN is held in the PinStore and, when configured, written to the PIN escrow
+// extension attribute. The command has already been sent, so a failure to write the extension attribute is logged as a
+// security event rather than returned; the PIN can then only be retrieved from the PinStore until the service restarts
+func (s Server) escrowPin(comp jamf.Computer, command string, pin string) {
+	s.PinStore.put(EscrowedPin{
+		Udid:         comp.Udid,
+		SerialNumber: comp.SerialNumber,
+		ComputerId:   comp.Id,
+		Command:      command,
+		Pin:          pin,
+		Escrowed:     time.Now(),
+	})
+
+	fields := map[string]interface{}{
+		"event":      "pin_escrowed",
+		"udid":       comp.Udid,
+		"serial":     comp.SerialNumber,
+		"computerId": comp.Id,
+		"command":    command,
+	}
+
+	eaName := s.env()[EnvPinEscrowExtAttName]
+	if eaName == "" {
+		logger.WithFields(fields).Warnf("PIN escrowed in memory only, %s is not set", EnvPinEscrowExtAttName)
+		return
+	}
+
+	// the command has been sent, so the PIN is escrowed even if the request's Jamf deadline has passed
+	if err := s.jamf.WithContext(context.Background()).SetExtensionAttribute(comp, eaName, pin); err != nil {
+		fields["event"] = "pin_escrow_failed"
+		fields["security"] = true
+		logger.WithFields(fields).Errorf("could not escrow PIN to extension attribute '%s', "+
+			"it is only held in memory until the service restarts: %s", eaName, err)
+		return
+	}
+
+	logger.WithFields(fields).Info("PIN escrowed")
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/jamf"
+	"command-on-demand/internal/logger"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+const (
+	PolicyModeReject = "reject"
+	PolicyModeClamp  = "clamp"
+
+	// allGroups can be used in the deny major groups list to match every computer
+	allGroups = "*"
+)
+
+// SoftwareUpdatePolicy is an operator defined policy which bounds the software update parameters clients may request.
+// Parameters outside the policy are either rejected or clamped to the policy limits, depending on the mode.
+type SoftwareUpdatePolicy struct {
+	clamp             bool
+	maxVersion        string
+	denyMajorGroups   []string
+	forceRestartHours *hourWindow
+	maxDeferrals      *int
+}
+
+// hourWindow is a range of hours in the day, in server local time. The end hour is exclusive, so an end of 24
+// runs until midnight. A window where the start hour is after the end hour wraps past midnight, e.g. 18-6
+type hourWindow struct {
+	start int
+	end   int
+}
+
+// NewSoftwareUpdatePolicy builds a SoftwareUpdatePolicy from the given Environment.
+// Any unset policy variable leaves that parameter unbounded.
+func NewSoftwareUpdatePolicy(env Environment) (p SoftwareUpdatePolicy, err error) {
+	switch mode := env[EnvSwupdPolicyMode]; mode {
+	case "", PolicyModeReject:
+		p.clamp = false
+	case PolicyModeClamp:
+		p.clamp = true
+	default:
+		return p, fmt.Errorf("invalid software update policy mode: %s", mode)
+	}
+
+	if v, ok := env[EnvSwupdPolicyMaxVersion]; ok && v != "" {
+		if !semver.IsValid("v" + v) {
+			return p, fmt.Errorf("invalid software update policy max version: %s", v)
+		}
+		p.maxVersion = v
+	}
+
+	if v, ok := env[EnvSwupdPolicyDenyMajorGroups]; ok && v != "" {
+		p.denyMajorGroups = splitList(v)
+	}
+
+	if v, ok := env[EnvSwupdPolicyForceRestartHours]; ok && v != "" {
+		p.forceRestartHours, err = parseHourWindow(v)
+		if err != nil {
+			return p, err
+		}
+	}
+
+	if v, ok := env[EnvSwupdPolicyMaxDeferrals]; ok && v != "" {
+		md, err := strconv.Atoi(v)
+		if err != nil || md < 0 {
+			return p, fmt.Errorf("invalid software update policy max deferrals: %s", v)
+		}
+		p.maxDeferrals = &md
+	}
+
+	return p, nil
+}
+
+// Apply checks the requested software update parameters for the given computer against the policy.
+// In clamp mode, out of policy parameters are modified in place where possible, otherwise an error is returned.
+func (p SoftwareUpdatePolicy) Apply(u *softwareUpdateRequest, comp jamf.Computer, now time.Time) error {
+	if p.maxVersion != "" {
+		// an empty target version means latest, which could be beyond the maximum
+		if u.TargetVersion == "" || semver.Compare("v"+u.TargetVersion, "v"+p.maxVersion) > 0 {
+			if !p.clamp {
+				return errors.UpdatePolicyVersionNotAllowed
+			}
+			logger.Infof("software update policy: clamping targetVersion '%s' to %s", u.TargetVersion, p.maxVersion)
+			u.TargetVersion = p.maxVersion
+		}
+	}
+
+	if p.denyMajor(comp) {
+		if u.TargetVersion != "" {
+			// a specific target version is installed regardless of applyMajorUpdate, so cannot be clamped
+			current := comp.OsVersion
+			if current == "" || semver.Compare(semver.Major("v"+u.TargetVersion), semver.Major("v"+current)) > 0 {
+				logger.Debugf("software update policy: target %s is a major update from '%s'", u.TargetVersion, current)
+				return errors.UpdatePolicyMajorNotAllowed
+			}
+		}
+
+		if u.ApplyMajorUpdate {
+			if !p.clamp {
+				return errors.UpdatePolicyMajorNotAllowed
+			}
+			logger.Info("software update policy: clamping applyMajorUpdate to false")
+			u.ApplyMajorUpdate = false
+		}
+	}
+
+	if p.forceRestartHours != nil && u.ForceRestart && !p.forceRestartHours.contains(now) {
+		if !p.clamp {
+			return errors.UpdatePolicyForceRestartNotAllowed
+		}
+		logger.Info("software update policy: clamping forceRestart to false")
+		u.ForceRestart = false
+	}
+
+	if p.maxDeferrals != nil && u.MaxDeferrals > *p.maxDeferrals {
+		if !p.clamp {
+			return errors.UpdatePolicyMaxDeferralsExceeded
+		}
+		logger.Infof("software update policy: clamping maxDeferrals %d to %d", u.MaxDeferrals, *p.maxDeferrals)
+		u.MaxDeferrals = *p.maxDeferrals
+	}
+
+	return nil
+}
+
+// needsComputerDetails returns true if the policy uses the group memberships of computers,
+// which are then requested when looking up computers, see jamf.Client.SetPolicyLookup
+func (p SoftwareUpdatePolicy) needsComputerDetails() bool {
+	return len(p.denyMajorGroups) > 0
+}
+
+// denyMajor returns true if major updates are not allowed for the given computer
+func (p SoftwareUpdatePolicy) denyMajor(comp jamf.Computer) bool {
+	for _, g := range p.denyMajorGroups {
+		if g == allGroups || comp.InGroup(g) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHourWindow parses a window in the form "start-end", where start is an hour in the range 0-23,
+// and end an hour in the range 0-24
+func parseHourWindow(v string) (*hourWindow, error) {
+	s, e, ok := strings.Cut(v, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid hour window, expected start-end: %s", v)
+	}
+
+	start, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || start < 0 || start > 23 {
+		return nil, fmt.Errorf("invalid start hour in window: %s", v)
+	}
+
+	end, err := strconv.Atoi(strings.TrimSpace(e))
+	if err != nil || end < 0 || end > 24 {
+		return nil, fmt.Errorf("invalid end hour in window: %s", v)
+	}
+
+	if start == end {
+		return nil, fmt.Errorf("hour window cannot be empty: %s", v)
+	}
+
+	return &hourWindow{start: start, end: end}, nil
+}
+
+// contains returns true if the given time falls within the window
+func (w hourWindow) contains(t time.Time) bool {
+	h := t.Hour()
+	if w.start < w.end {
+		return h >= w.start && h < w.end
+	}
+
+	return h >= w.start || h < w.end
+}
+
+// splitList splits a comma separated list, trimming whitespace and dropping empty items
+func splitList(v string) []string {
+	var l []string
+	for _, i := range strings.Split(v, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			l = append(l, i)
+		}
+	}
+
+	return l
+}
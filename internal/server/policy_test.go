@@ -0,0 +1,279 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/jamf"
+	e "errors"
+	"testing"
+	"time"
+)
+
+func TestParseHourWindow(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    hourWindow
+		wantErr bool
+	}{
+		{in: "9-17", want: hourWindow{start: 9, end: 17}},
+		{in: " 18 - 6 ", want: hourWindow{start: 18, end: 6}},
+		{in: "0-23", want: hourWindow{start: 0, end: 23}},
+		{in: "22-24", want: hourWindow{start: 22, end: 24}},
+		{in: "0-24", want: hourWindow{start: 0, end: 24}},
+		{in: "9", wantErr: true},
+		{in: "9-9", wantErr: true},
+		{in: "24-6", wantErr: true},
+		{in: "6-25", wantErr: true},
+		{in: "-1-6", wantErr: true},
+		{in: "a-b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		w, err := parseHourWindow(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseHourWindow(%q): expected an error, got %+v", tt.in, *w)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseHourWindow(%q): unexpected error: %s", tt.in, err)
+			continue
+		}
+
+		if *w != tt.want {
+			t.Errorf("parseHourWindow(%q) = %+v, want %+v", tt.in, *w, tt.want)
+		}
+	}
+}
+
+func TestHourWindowContains(t *testing.T) {
+	day := hourWindow{start: 9, end: 17}
+	night := hourWindow{start: 18, end: 6}
+	evening := hourWindow{start: 22, end: 24}
+	allDay := hourWindow{start: 0, end: 24}
+
+	tests := []struct {
+		w    hourWindow
+		hour int
+		want bool
+	}{
+		{day, 8, false},
+		{day, 9, true},
+		{day, 16, true},
+		{day, 17, false},
+		{night, 17, false},
+		{night, 18, true},
+		{night, 23, true},
+		{night, 0, true},
+		{night, 5, true},
+		{night, 6, false},
+		{evening, 21, false},
+		{evening, 22, true},
+		{evening, 23, true},
+		{evening, 0, false},
+		{allDay, 0, true},
+		{allDay, 23, true},
+	}
+
+	for _, tt := range tests {
+		at := time.Date(2024, 6, 1, tt.hour, 30, 0, 0, time.Local)
+		if got := tt.w.contains(at); got != tt.want {
+			t.Errorf("%+v contains %02d:30 = %t, want %t", tt.w, tt.hour, got, tt.want)
+		}
+	}
+}
+
+func testComputer(osVersion string, groups ...string) jamf.Computer {
+	var c jamf.Computer
+	c.OsVersion = osVersion
+	c.ComputerGroupMemberships = groups
+
+	return c
+}
+
+func TestSoftwareUpdatePolicyApply(t *testing.T) {
+	noon := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	night := time.Date(2024, 6, 1, 22, 0, 0, 0, time.Local)
+
+	policy := func(env Environment) SoftwareUpdatePolicy {
+		p, err := NewSoftwareUpdatePolicy(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		env     Environment
+		req     func(u *softwareUpdateRequest)
+		comp    jamf.Computer
+		now     time.Time
+		wantErr error
+		check   func(u softwareUpdateRequest) bool
+	}{
+		{
+			name: "no policy allows defaults",
+			env:  Environment{},
+			comp: testComputer("14.5"),
+			now:  noon,
+			check: func(u softwareUpdateRequest) bool {
+				return u.ApplyMajorUpdate && u.ForceRestart && u.TargetVersion == ""
+			},
+		},
+		{
+			name:    "reject latest above max version",
+			env:     Environment{EnvSwupdPolicyMaxVersion: "14.6.1"},
+			comp:    testComputer("14.5"),
+			now:     noon,
+			wantErr: errors.UpdatePolicyVersionNotAllowed,
+		},
+		{
+			name:    "reject target above max version",
+			env:     Environment{EnvSwupdPolicyMaxVersion: "14.6.1"},
+			req:     func(u *softwareUpdateRequest) { u.TargetVersion = "14.7" },
+			comp:    testComputer("14.5"),
+			now:     noon,
+			wantErr: errors.UpdatePolicyVersionNotAllowed,
+		},
+		{
+			name:  "allow target at max version",
+			env:   Environment{EnvSwupdPolicyMaxVersion: "14.6.1"},
+			req:   func(u *softwareUpdateRequest) { u.TargetVersion = "14.6.1" },
+			comp:  testComputer("14.5"),
+			now:   noon,
+			check: func(u softwareUpdateRequest) bool { return u.TargetVersion == "14.6.1" },
+		},
+		{
+			name:  "clamp latest to max version",
+			env:   Environment{EnvSwupdPolicyMode: PolicyModeClamp, EnvSwupdPolicyMaxVersion: "14.6.1"},
+			comp:  testComputer("14.5"),
+			now:   noon,
+			check: func(u softwareUpdateRequest) bool { return u.TargetVersion == "14.6.1" },
+		},
+		{
+			name:    "reject major update for denied group",
+			env:     Environment{EnvSwupdPolicyDenyMajorGroups: "Lab Macs"},
+			comp:    testComputer("14.5", "Lab Macs"),
+			now:     noon,
+			wantErr: errors.UpdatePolicyMajorNotAllowed,
+		},
+		{
+			name:  "allow major update outside denied group",
+			env:   Environment{EnvSwupdPolicyDenyMajorGroups: "Lab Macs"},
+			comp:  testComputer("14.5", "Finance Macs"),
+			now:   noon,
+			check: func(u softwareUpdateRequest) bool { return u.ApplyMajorUpdate },
+		},
+		{
+			name:  "clamp major update for all groups",
+			env:   Environment{EnvSwupdPolicyMode: PolicyModeClamp, EnvSwupdPolicyDenyMajorGroups: allGroups},
+			comp:  testComputer("14.5"),
+			now:   noon,
+			check: func(u softwareUpdateRequest) bool { return !u.ApplyMajorUpdate },
+		},
+		{
+			name: "major target version cannot be clamped",
+			env:  Environment{EnvSwupdPolicyMode: PolicyModeClamp, EnvSwupdPolicyDenyMajorGroups: allGroups},
+			req: func(u *softwareUpdateRequest) {
+				u.TargetVersion = "15.0"
+				u.ApplyMajorUpdate = false
+			},
+			comp:    testComputer("14.5"),
+			now:     noon,
+			wantErr: errors.UpdatePolicyMajorNotAllowed,
+		},
+		{
+			name:    "major target version with unknown current version",
+			env:     Environment{EnvSwupdPolicyDenyMajorGroups: allGroups},
+			req:     func(u *softwareUpdateRequest) { u.TargetVersion = "14.6"; u.ApplyMajorUpdate = false },
+			comp:    testComputer(""),
+			now:     noon,
+			wantErr: errors.UpdatePolicyMajorNotAllowed,
+		},
+		{
+			name:  "minor target version for denied group",
+			env:   Environment{EnvSwupdPolicyDenyMajorGroups: allGroups},
+			req:   func(u *softwareUpdateRequest) { u.TargetVersion = "14.6"; u.ApplyMajorUpdate = false },
+			comp:  testComputer("14.5"),
+			now:   noon,
+			check: func(u softwareUpdateRequest) bool { return u.TargetVersion == "14.6" },
+		},
+		{
+			name:    "reject force restart outside hours",
+			env:     Environment{EnvSwupdPolicyForceRestartHours: "18-6"},
+			comp:    testComputer("14.5"),
+			now:     noon,
+			wantErr: errors.UpdatePolicyForceRestartNotAllowed,
+		},
+		{
+			name:  "allow force restart within hours",
+			env:   Environment{EnvSwupdPolicyForceRestartHours: "18-6"},
+			comp:  testComputer("14.5"),
+			now:   night,
+			check: func(u softwareUpdateRequest) bool { return u.ForceRestart },
+		},
+		{
+			name:  "clamp force restart outside hours",
+			env:   Environment{EnvSwupdPolicyMode: PolicyModeClamp, EnvSwupdPolicyForceRestartHours: "18-6"},
+			comp:  testComputer("14.5"),
+			now:   noon,
+			check: func(u softwareUpdateRequest) bool { return !u.ForceRestart },
+		},
+		{
+			name:    "reject deferrals above max",
+			env:     Environment{EnvSwupdPolicyMaxDeferrals: "3"},
+			req:     func(u *softwareUpdateRequest) { u.MaxDeferrals = 5 },
+			comp:    testComputer("14.5"),
+			now:     noon,
+			wantErr: errors.UpdatePolicyMaxDeferralsExceeded,
+		},
+		{
+			name:  "clamp deferrals to max",
+			env:   Environment{EnvSwupdPolicyMode: PolicyModeClamp, EnvSwupdPolicyMaxDeferrals: "3"},
+			req:   func(u *softwareUpdateRequest) { u.MaxDeferrals = 5 },
+			comp:  testComputer("14.5"),
+			now:   noon,
+			check: func(u softwareUpdateRequest) bool { return u.MaxDeferrals == 3 },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newSoftwareUpdateRequest()
+			if tt.req != nil {
+				tt.req(&u)
+			}
+
+			err := policy(tt.env).Apply(&u, tt.comp, tt.now)
+			if tt.wantErr != nil {
+				if !e.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !tt.check(u) {
+				t.Errorf("unexpected parameters after policy: %+v", u)
+			}
+		})
+	}
+}
+
+func TestNewSoftwareUpdatePolicyInvalid(t *testing.T) {
+	for _, env := range []Environment{
+		{EnvSwupdPolicyMode: "ignore"},
+		{EnvSwupdPolicyMaxVersion: "fourteen"},
+		{EnvSwupdPolicyForceRestartHours: "18"},
+		{EnvSwupdPolicyMaxDeferrals: "-1"},
+	} {
+		if _, err := NewSoftwareUpdatePolicy(env); err == nil {
+			t.Errorf("expected an error for %v", env)
+		}
+	}
+}
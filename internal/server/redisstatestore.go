@@ -0,0 +1,113 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/logger"
+	"context"
+	e "errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisStateKeyPrefix = "cmdod:state:"
+	// redisUpdateAttempts is the number of times an update is attempted when its key is modified by another replica
+	redisUpdateAttempts = 10
+)
+
+// RedisStateStore stores state in the Redis-protocol server of the RedisCodeStore, so it is shared between replicas.
+// Keys expire using native TTLs, so no pruning is required, and updates are optimistic transactions on the key
+type RedisStateStore struct {
+	client    *redis.Client
+	keyPrefix string
+}
+
+// NewRedisStateStore connects to the Redis-protocol server at the given URL, see NewRedisCodeStore.
+// Keys include the given namespace, so several tenants can share a server
+func NewRedisStateStore(rawUrl string, namespace string) (*RedisStateStore, error) {
+	if rawUrl == "" {
+		return nil, fmt.Errorf("%s code store requires %s to be set", CodeStoreRedis, EnvCodeStoreRedisUrl)
+	}
+
+	client, err := newRedisClient(rawUrl)
+	if err != nil {
+		return nil, errors.StateStoreFailed.Wrap(err)
+	}
+
+	return &RedisStateStore{client: client, keyPrefix: redisNamespacePrefix(redisStateKeyPrefix, namespace)}, nil
+}
+
+// get returns the value of the given key, or nil if it is not set or has expired
+func (c *RedisStateStore) get(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	v, err := c.client.Get(ctx, c.keyPrefix+key).Bytes()
+	if e.Is(err, redis.Nil) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.StateStoreFailed.Wrap(err)
+	}
+
+	return v, nil
+}
+
+// update atomically replaces the value of the given key with the value returned by fn, see StateStore.
+// The key is watched, and the update is retried if another replica modifies it before the update is written
+func (c *RedisStateStore) update(key string, ttl time.Duration, fn func(v []byte) ([]byte, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	key = c.keyPrefix + key
+	var fnErr error
+	txf := func(tx *redis.Tx) error {
+		v, err := tx.Get(ctx, key).Bytes()
+		if e.Is(err, redis.Nil) {
+			v, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if v, fnErr = fn(v); fnErr != nil {
+			return fnErr
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if v == nil {
+				return p.Del(ctx, key).Err()
+			}
+			return p.Set(ctx, key, v, ttl).Err()
+		})
+		return err
+	}
+
+	for i := 0; i < redisUpdateAttempts; i++ {
+		err := c.client.Watch(ctx, txf, key)
+		if fnErr != nil {
+			return fnErr
+		}
+
+		if e.Is(err, redis.TxFailedErr) {
+			logger.Debugf("state %s modified during update, retrying", key)
+			continue
+		}
+
+		if err != nil {
+			return errors.StateStoreFailed.Wrap(err)
+		}
+
+		return nil
+	}
+
+	return errors.StateStoreFailed.Wrap(fmt.Errorf("state %s modified during %d update attempts", key, redisUpdateAttempts))
+}
+
+// Prune returns immediately, as state is expired by Redis key TTLs
+func (c *RedisStateStore) Prune(time.Duration) {
+	logger.Debug("Redis state store uses key TTLs, pruning is not required")
+}
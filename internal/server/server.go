@@ -1,25 +1,111 @@
 package server
 
 import (
+	"command-on-demand/internal/audit"
 	"command-on-demand/internal/errors"
 	"command-on-demand/internal/jamf"
 	"command-on-demand/internal/logger"
+	"command-on-demand/internal/notify"
 	"encoding/json"
 	e "errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	eraseDevicePin = "000000"
+	maxBodyBytes = 64 << 10
+	// JamfDeadline is the longest a request waits on the Jamf API, including retries, before its response is written.
+	// The write timeout of the HTTP server must be longer, so the outcome still reaches the client
+	JamfDeadline = 12 * time.Second
+)
+
+// Jamf authentication modes
+const (
+	JamfAuthModeBasic = "basic"
+	JamfAuthModeOAuth = "oauth"
 )
 
 type Server struct {
-	env       Environment
-	jamf      *jamf.Client
-	CodeStore *CodeStore
+	tenant     string
+	config     *atomic.Pointer[serverConfig]
+	jamf       *jamf.Client
+	tracking   TrackingConfig
+	Lockout    *Lockout
+	Guard      *CommandGuard
+	CodeStore  CodeStore
+	StateStore StateStore
+	PinStore   *PinStore
+	JobStore   *JobStore
+	Notifier   *notify.Dispatcher
+	auditLog   *audit.Log
+}
+
+// serverConfig is the part of the Server's configuration which can be reloaded while the service is running.
+// It is replaced as a whole, so requests in flight keep using the configuration they loaded
+type serverConfig struct {
+	env         Environment
+	commands    map[string]bool
+	swupdPolicy SoftwareUpdatePolicy
+	erase       EraseConfig
+	tokens      *TokenRegistry
+	webhooks    []notify.Target
+}
+
+// newServerConfig builds the reloadable configuration of a Server from the given Environment
+func newServerConfig(env Environment) (c *serverConfig, err error) {
+	c = &serverConfig{env: env}
+
+	if _, err = env.Port(EnvAdminListenPort, ""); err != nil {
+		return nil, err
+	}
+
+	if c.commands, err = newCommandSet(env); err != nil {
+		return nil, err
+	}
+
+	if c.swupdPolicy, err = NewSoftwareUpdatePolicy(env); err != nil {
+		return nil, err
+	}
+
+	if c.erase, err = NewEraseConfig(env); err != nil {
+		return nil, err
+	}
+
+	if c.tokens, err = NewTokenRegistry(env); err != nil {
+		return nil, err
+	}
+
+	if c.webhooks, err = newWebhookTargets(env); err != nil {
+		return nil, err
+	}
+
+	if env[EnvPinEscrowExtAttName] == "" && (c.enabled(CommandEraseDevice) || c.enabled(CommandDeviceLock)) {
+		logger.Warnf("%s is not set while the erase or lock command is enabled, so their PINs are only held in memory "+
+			"until the service restarts. Set it, or disable both commands with %s", EnvPinEscrowExtAttName, EnvCommands)
+	}
+
+	if admin := env[EnvAdminBearerToken]; admin != "" {
+		secret, err := parseTokenSecret(admin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", EnvAdminBearerToken, err)
+		}
+
+		if c.tokens.hasSecret(secret) {
+			return nil, fmt.Errorf("%s must differ from every client token", EnvAdminBearerToken)
+		}
+	}
+
+	return c, nil
+}
+
+// enabled returns true if the named command is enabled by EnvCommands
+func (c *serverConfig) enabled(name string) bool {
+	return c.commands == nil || c.commands[name]
 }
 
 // ServiceResponse represents the return body for request responses
@@ -28,6 +114,7 @@ type ServiceResponse struct {
 	Message     string `json:"message,omitempty"`
 	IsError     bool   `json:"error"`
 	ErrorOrigin string `json:"errorOrigin,omitempty"`
+	JobId       string `json:"jobId,omitempty"`
 }
 
 func (e ServiceResponse) Error() string {
@@ -37,35 +124,186 @@ func (e ServiceResponse) Error() string {
 	return fmt.Sprintf("%s. status: %d", e.Message, e.Status)
 }
 
-func NewServer() Server {
-	env, err := NewEnvironment("CMDOD_")
+// NewServer creates the Server for the named tenant, configured with the given Environment.
+// The tenant name is empty when a single Jamf instance is configured, see NewTenants
+func NewServer(env Environment, tenant string) Server {
+	config, err := newServerConfig(env)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	auth := jamf.BasicAuth{
-		Username: env[EnvJamfAPIUser],
-		Password: env[EnvJamfAPIPassword],
+	auth, err := newJamfAuth(env)
+	if err != nil {
+		logger.Fatal(err)
 	}
 
-	client, err := jamf.NewClient(env[EnvJamfFQDN], auth)
+	opts, err := newJamfClientOptions(env)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	store := NewCodeStore()
+	client, err := jamf.NewClient(env[EnvJamfFQDN], auth, opts)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	client.SetPolicyLookup(config.swupdPolicy.needsComputerDetails())
+
+	tracking, err := NewTrackingConfig(env)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	lockout, err := NewLockoutConfig(env)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	guard, err := NewGuardConfig(env)
+	if err != nil {
+		logger.Fatal(err)
+	}
 
-	svc := Server{jamf: client, env: env, CodeStore: store}
+	codes, err := NewCodeStoreFromEnv(env, tenant)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	state, err := NewStateStoreFromEnv(env, tenant)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	auditLog, err := openAuditLog(env, tenant)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	notifier, err := newNotifier(env, tenant, config.webhooks)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	svc := Server{
+		tenant:     tenant,
+		config:     &atomic.Pointer[serverConfig]{},
+		jamf:       client,
+		tracking:   tracking,
+		Lockout:    NewLockout(lockout, state, notifier),
+		Guard:      NewCommandGuard(guard, state, notifier),
+		CodeStore:  codes,
+		StateStore: state,
+		PinStore:   NewPinStore(),
+		JobStore:   NewJobStore(),
+		Notifier:   notifier,
+		auditLog:   auditLog,
+	}
+	svc.config.Store(config)
 
 	return svc
 }
 
-func (s Server) token() string {
-	return s.env[EnvServerBearerToken]
+// newCommandSet returns the names of the commands enabled by EnvCommands, or nil if all commands are enabled
+func newCommandSet(env Environment) (map[string]bool, error) {
+	aliases := splitList(env[EnvCommands])
+	if len(aliases) == 0 {
+		return nil, nil
+	}
+
+	commands := make(map[string]bool)
+	for _, a := range aliases {
+		name, ok := commandAliases[a]
+		if !ok {
+			return nil, fmt.Errorf("invalid value for %s: unknown command %s", EnvCommands, a)
+		}
+		commands[name] = true
+	}
+
+	return commands, nil
+}
+
+// newJamfAuth returns the Jamf authentication method selected by EnvJamfAuthMode.
+// Basic auth with a Jamf user account is the default, oauth uses the client credentials of a Jamf API client
+func newJamfAuth(env Environment) (jamf.Auth, error) {
+	switch env[EnvJamfAuthMode] {
+	case "", JamfAuthModeBasic:
+		return jamf.BasicAuth{
+			Username: env[EnvJamfAPIUser],
+			Password: env[EnvJamfAPIPassword],
+		}, nil
+	case JamfAuthModeOAuth:
+		return jamf.ClientCredentials{
+			ClientId:     env[EnvJamfClientId],
+			ClientSecret: env[EnvJamfClientSecret],
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid value for %s: %s", EnvJamfAuthMode, env[EnvJamfAuthMode])
+}
+
+// newJamfClientOptions builds the Jamf client computer lookup, timeout, retry and circuit breaker options
+// from the given Environment
+func newJamfClientOptions(env Environment) (o jamf.ClientOptions, err error) {
+	d := jamf.DefaultClientOptions()
+
+	switch o.ComputerLookup = env[EnvJamfComputerLookup]; o.ComputerLookup {
+	case "":
+		o.ComputerLookup = d.ComputerLookup
+	case jamf.ComputerLookupPro, jamf.ComputerLookupClassic:
+	default:
+		return o, fmt.Errorf("invalid value for %s: %s", EnvJamfComputerLookup, o.ComputerLookup)
+	}
+
+	if o.Timeout, err = env.Duration(EnvJamfTimeout, d.Timeout); err != nil {
+		return
+	}
+
+	if o.MaxRetries, err = env.Int(EnvJamfMaxRetries, d.MaxRetries); err != nil {
+		return
+	}
+
+	if o.RetryBaseDelay, err = env.Duration(EnvJamfRetryBaseDelay, d.RetryBaseDelay); err != nil {
+		return
+	}
+
+	if o.RetryMaxDelay, err = env.Duration(EnvJamfRetryMaxDelay, d.RetryMaxDelay); err != nil {
+		return
+	}
+
+	if o.BreakerThreshold, err = env.Int(EnvJamfBreakerThreshold, d.BreakerThreshold); err != nil {
+		return
+	}
+
+	o.BreakerCooldown, err = env.Duration(EnvJamfBreakerCooldown, d.BreakerCooldown)
+
+	return
+}
+
+// RefreshJamfToken is a goroutine that renews the Jamf API token before it expires, see jamf.Client.RefreshToken
+func (s Server) RefreshJamfToken() {
+	s.jamf.RefreshToken()
+}
+
+// Tenant returns the name of the Server's tenant, which is empty when a single Jamf instance is configured
+func (s Server) Tenant() string {
+	return s.tenant
+}
+
+// cfg returns the Server's current reloadable configuration
+func (s Server) cfg() *serverConfig {
+	return s.config.Load()
+}
+
+// env returns the Server's current Environment
+func (s Server) env() Environment {
+	return s.cfg().env
+}
+
+func (s Server) adminToken() string {
+	return s.env()[EnvAdminBearerToken]
 }
 
 func (s Server) ListenInterface() string {
-	i, ok := s.env[EnvServiceListenInterface]
+	i, ok := s.env()[EnvServiceListenInterface]
 	if !ok {
 		return "0.0.0.0"
 	}
@@ -78,7 +316,7 @@ func (s Server) ListenInterface() string {
 }
 
 func (s Server) ListenPort() string {
-	p, ok := s.env[EnvServiceListenPort]
+	p, ok := s.env()[EnvServiceListenPort]
 	if !ok {
 		return "8080"
 	}
@@ -91,6 +329,33 @@ func (s Server) ListenPort() string {
 	return p
 }
 
+// AdminListenPort returns the port admin endpoints are served on, or empty if they are served on ListenPort.
+// An invalid port is rejected by newServerConfig, so the service does not start
+func (s Server) AdminListenPort() string {
+	p, _ := s.env().Port(EnvAdminListenPort, "")
+
+	return p
+}
+
+// decodeBody decodes an optional JSON request body into v.
+// An empty body is not an error and leaves v untouched, so callers should populate v with defaults beforehand.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if e.Is(err, io.EOF) {
+		return nil
+	}
+
+	if err != nil {
+		logger.Debugf("could not decode request body: %s", err)
+		return errors.BodyInvalid
+	}
+
+	return nil
+}
+
 // writeResponse writes a ServiceResponse to the response body and sets the response status
 func writeResponse(w http.ResponseWriter, status int, msg string) {
 	w.WriteHeader(status)
@@ -103,6 +368,19 @@ func writeResponse(w http.ResponseWriter, status int, msg string) {
 	json.NewEncoder(w).Encode(&r)
 }
 
+// writeJobResponse writes a ServiceResponse referencing a job to the response body and sets the response status
+func writeJobResponse(w http.ResponseWriter, status int, msg string, jobId string) {
+	w.WriteHeader(status)
+
+	r := ServiceResponse{
+		Status:  &status,
+		Message: msg,
+		IsError: false,
+		JobId:   jobId,
+	}
+	json.NewEncoder(w).Encode(&r)
+}
+
 // writeErrorResponse writes an error to the response body and sets the response status
 func writeErrorResponse(w http.ResponseWriter, err error) {
 	status, msg, origin := classifyError(err)
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"command-on-demand/internal/logger"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StateStore is the interface for storage of lockout and command guard state. It uses the code store backend,
+// so state survives restarts with the bolt backend and is shared between replicas with the Redis backend
+// get returns the value of a key, or nil if it is not set or has expired
+// update atomically replaces the value of a key with the value returned by fn, which is passed the current value,
+// or nil if it is not set. The key is removed if fn returns nil, and expires after ttl if ttl is greater than 0.
+// fn may be called more than once, so must not have side effects, and an error returned by fn is returned by update
+// Prune is a goroutine which periodically removes expired keys, if the backend requires it
+type StateStore interface {
+	Prune(every time.Duration)
+	get(key string) ([]byte, error)
+	update(key string, ttl time.Duration, fn func(v []byte) ([]byte, error)) error
+}
+
+// NewStateStoreFromEnv returns the StateStore for the code store backend configured in the given Environment.
+// State is isolated by namespace, which is the tenant name, or empty when there is a single tenant
+func NewStateStoreFromEnv(env Environment, namespace string) (StateStore, error) {
+	switch backend := env[EnvCodeStore]; backend {
+	case "", CodeStoreMemory:
+		return NewMemoryStateStore(), nil
+	case CodeStoreBolt:
+		return NewBoltStateStore(env[EnvCodeStorePath], namespace)
+	case CodeStoreRedis:
+		return NewRedisStateStore(env[EnvCodeStoreRedisUrl], namespace)
+	default:
+		return nil, fmt.Errorf("invalid code store: %s", backend)
+	}
+}
+
+// stateExpiry returns the expiry time of a value stored with the given ttl, which is zero if it does not expire
+func stateExpiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
+
+// stateExpired returns true if a value with the given expiry time has expired
+func stateExpired(expires time.Time) bool {
+	return !expires.IsZero() && time.Now().After(expires)
+}
+
+// memoryState is a value in the MemoryStateStore
+type memoryState struct {
+	value   []byte
+	expires time.Time
+}
+
+// MemoryStateStore stores state in memory and provides a mutex for safe concurrent access.
+// State is lost on restart and is not shared between replicas
+type MemoryStateStore struct {
+	sync.Mutex
+	values map[string]memoryState
+}
+
+// NewMemoryStateStore creates a new instance of MemoryStateStore with no state
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		values: make(map[string]memoryState),
+	}
+}
+
+// get returns the value of the given key, or nil if it is not set or has expired
+func (m *MemoryStateStore) get(key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	s, ok := m.values[key]
+	if !ok || stateExpired(s.expires) {
+		return nil, nil
+	}
+
+	return s.value, nil
+}
+
+// update atomically replaces the value of the given key with the value returned by fn, see StateStore
+func (m *MemoryStateStore) update(key string, ttl time.Duration, fn func(v []byte) ([]byte, error)) error {
+	m.Lock()
+	defer m.Unlock()
+
+	var v []byte
+	if s, ok := m.values[key]; ok && !stateExpired(s.expires) {
+		v = s.value
+	}
+
+	v, err := fn(v)
+	if err != nil {
+		return err
+	}
+
+	if v == nil {
+		delete(m.values, key)
+		return nil
+	}
+
+	m.values[key] = memoryState{value: v, expires: stateExpiry(ttl)}
+
+	return nil
+}
+
+// Prune is a goroutine that runs every given interval and removes expired state from the MemoryStateStore
+func (m *MemoryStateStore) Prune(every time.Duration) {
+	for range time.Tick(every) {
+		m.Lock()
+		for key, s := range m.values {
+			if stateExpired(s.expires) {
+				delete(m.values, key)
+				logger.Debugf("pruned expired state %s", key)
+			}
+		}
+		m.Unlock()
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	e "errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testStateStores returns an empty store of each backend
+func testStateStores(t *testing.T) map[string]StateStore {
+	t.Helper()
+
+	bolt, err := NewBoltStateStore(filepath.Join(t.TempDir(), "codes.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]StateStore{
+		CodeStoreMemory: NewMemoryStateStore(),
+		CodeStoreBolt:   bolt,
+		CodeStoreRedis:  newTestRedisStateStore(t, miniredis.RunT(t)),
+	}
+}
+
+func TestStateStoreUpdate(t *testing.T) {
+	for backend, st := range testStateStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			if v, err := st.get("k"); err != nil || v != nil {
+				t.Fatalf("expected no value, got %q (%v)", v, err)
+			}
+
+			set := func(next string) func(v []byte) ([]byte, error) {
+				return func(v []byte) ([]byte, error) { return []byte(next), nil }
+			}
+			if err := st.update("k", time.Minute, set("a")); err != nil {
+				t.Fatal(err)
+			}
+
+			var prev []byte
+			err := st.update("k", time.Minute, func(v []byte) ([]byte, error) {
+				prev = v
+				return append(v, 'b'), nil
+			})
+			if err != nil || string(prev) != "a" {
+				t.Fatalf("expected update to be passed the current value, got %q (%v)", prev, err)
+			}
+
+			if v, _ := st.get("k"); string(v) != "ab" {
+				t.Errorf("expected updated value ab, got %q", v)
+			}
+
+			fnErr := e.New("refused")
+			if err = st.update("k", time.Minute, func([]byte) ([]byte, error) { return nil, fnErr }); err != fnErr {
+				t.Errorf("expected the update function's error, got %v", err)
+			}
+
+			if v, _ := st.get("k"); string(v) != "ab" {
+				t.Errorf("expected failed update to keep the value, got %q", v)
+			}
+
+			if err = st.update("k", 0, func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+				t.Fatal(err)
+			}
+
+			if v, _ := st.get("k"); v != nil {
+				t.Errorf("expected value to be removed, got %q", v)
+			}
+		})
+	}
+}
+
+func TestStateStoreExpiry(t *testing.T) {
+	// Redis expires keys natively, see TestLockoutSharedBetweenReplicas
+	stores := testStateStores(t)
+	for _, backend := range []string{CodeStoreMemory, CodeStoreBolt} {
+		st := stores[backend]
+		t.Run(backend, func(t *testing.T) {
+			if err := st.update("k", 20*time.Millisecond, func([]byte) ([]byte, error) { return []byte("v"), nil }); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(40 * time.Millisecond)
+
+			if v, err := st.get("k"); err != nil || v != nil {
+				t.Errorf("expected value to expire, got %q (%v)", v, err)
+			}
+		})
+	}
+}
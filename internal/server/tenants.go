@@ -0,0 +1,384 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/jamf"
+	"command-on-demand/internal/logger"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// envNamespace is the prefix of all environment variables read by the service
+	envNamespace = "CMDOD_"
+	// tenantEnvNamespace is the prefix of tenant environment variables, followed by the upper-cased tenant name
+	tenantEnvNamespace = envNamespace + "T_"
+	// configPollInterval is how often the config file is checked for modification
+	configPollInterval = 5 * time.Second
+)
+
+// restartSettings are the settings which are only read when the service starts. Changes to them are reported,
+// but not applied, when the configuration is reloaded, see Tenants.Reload
+var restartSettings = []string{
+	EnvTenants,
+	EnvJamfFQDN,
+	EnvServiceListenInterface,
+	EnvServiceListenPort,
+	EnvAdminListenPort,
+	EnvAuditLogPath,
+	EnvAuditHMACKey,
+	EnvWebhookQueueSize,
+	EnvWebhookWorkers,
+	EnvWebhookMaxAttempts,
+	EnvWebhookRetryBaseDelay,
+	EnvWebhookRetryMaxDelay,
+	EnvWebhookTimeout,
+	EnvWebhookDeadLetterPath,
+	EnvJamfComputerLookup,
+	EnvJamfTimeout,
+	EnvJamfMaxRetries,
+	EnvJamfRetryBaseDelay,
+	EnvJamfRetryMaxDelay,
+	EnvJamfBreakerThreshold,
+	EnvJamfBreakerCooldown,
+	EnvCodeStore,
+	EnvCodeStorePath,
+	EnvCodeStoreRedisUrl,
+	EnvLockoutFailureThreshold,
+	EnvLockoutCodeRequestThreshold,
+	EnvLockoutWindow,
+	EnvLockoutCooldown,
+	EnvTrustProxyHeaders,
+	EnvCooldownErase,
+	EnvCooldownLock,
+	EnvCooldownSwupd,
+	EnvCooldownRestart,
+	EnvCooldownShutdown,
+	EnvDestructiveBudget,
+	EnvDestructiveBudgetWindow,
+	EnvCommandTrackInterval,
+	EnvCommandPendingWarn,
+	EnvCommandTrackTimeout,
+}
+
+// validTenantName matches tenant names, which are used in request paths, environment variables and code store keys
+var validTenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Tenants holds a Server for each configured Jamf instance.
+// When EnvTenants is not set there is a single Server, configured as before tenants existed, whose tenant name is empty
+type Tenants struct {
+	configFile string
+	names      []string
+	servers    map[string]Server
+	// started is the Environment of each tenant when the service started, see restartSettings
+	started map[string]Environment
+}
+
+// NewTenants creates a Server for each tenant named in EnvTenants.
+// Each tenant's Environment is the CMDOD_ environment, overlaid with the variables prefixed with CMDOD_T_<TENANT>_,
+// e.g. CMDOD_T_ACME_JAMF_FQDN. Settings which are not overridden, such as lockout thresholds, are shared by all tenants,
+// while client tokens must be unique to each tenant so requests can be routed by token.
+// Settings are read from the config file at EnvConfigFile first, see loadConfigFile
+func NewTenants() *Tenants {
+	t := &Tenants{
+		configFile: os.Getenv(envNamespace + EnvConfigFile),
+		servers:    make(map[string]Server),
+	}
+
+	envs, err := t.environments()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	logger.SetLevel(envs[t.names[0]][EnvLogLevel])
+	t.started = envs
+
+	for _, name := range t.names {
+		if name != "" {
+			logger.Info("configuring tenant ", name)
+		}
+		t.servers[name] = NewServer(envs[name], name)
+	}
+
+	if err = t.checkTokensUnique(t.configs()); err != nil {
+		logger.Fatal(err)
+	}
+
+	return t
+}
+
+// environments reads the config file and environment variables, sets the tenant names if they are not yet set,
+// and returns the validated Environment of each tenant
+func (t *Tenants) environments() (map[string]Environment, error) {
+	file, err := loadConfigFile(t.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	base := readEnvironment(envNamespace, file)
+	names := splitList(base[EnvTenants])
+	if len(names) == 0 {
+		names = []string{""}
+	}
+
+	if t.names == nil {
+		t.names = names
+	} else if strings.Join(names, ",") != strings.Join(t.names, ",") {
+		return nil, fmt.Errorf("tenants cannot be changed without a restart")
+	}
+
+	envs := make(map[string]Environment)
+	for _, name := range names {
+		if name == "" {
+			if err = base.readSecretFiles(envNamespace); err != nil {
+				return nil, err
+			}
+			if err = base.validate(envNamespace); err != nil {
+				return nil, err
+			}
+			envs[name] = base
+			continue
+		}
+
+		if !validTenantName.MatchString(name) {
+			return nil, fmt.Errorf("invalid tenant name %s, must be lower case letters, numbers and hyphens", name)
+		}
+
+		if _, ok := envs[name]; ok {
+			return nil, fmt.Errorf("duplicate tenant name: %s", name)
+		}
+
+		namespace := tenantNamespace(name)
+		env := base.overlay(readEnvironment(namespace, file))
+		if err = env.readSecretFiles(namespace); err != nil {
+			return nil, err
+		}
+		if err = env.validate(namespace); err != nil {
+			return nil, err
+		}
+		envs[name] = env
+	}
+
+	return envs, nil
+}
+
+// configs returns the current reloadable configuration of each tenant
+func (t *Tenants) configs() map[string]*serverConfig {
+	configs := make(map[string]*serverConfig)
+	for _, name := range t.names {
+		configs[name] = t.servers[name].cfg()
+	}
+
+	return configs
+}
+
+// Reload re-reads the config file, environment variables and secret files and replaces the reloadable configuration of
+// every tenant: client tokens, enabled commands, the software update policy, the erase configuration, webhook targets,
+// other settings read from the Environment on each request, the Jamf API credentials and the logging level. Requests in flight
+// complete with the configuration they started with. Nothing is replaced if any tenant's configuration is invalid.
+// The settings in restartSettings which differ from when the service started are returned, as they are not applied
+func (t *Tenants) Reload() (restart []string, err error) {
+	envs, err := t.environments()
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]*serverConfig)
+	auths := make(map[string]jamf.Auth)
+	for _, name := range t.names {
+		if configs[name], err = newServerConfig(envs[name]); err == nil {
+			auths[name], err = newJamfAuth(envs[name])
+		}
+
+		if err != nil {
+			if name != "" {
+				return nil, fmt.Errorf("tenant %s: %w", name, err)
+			}
+			return nil, err
+		}
+	}
+
+	if err = t.checkTokensUnique(configs); err != nil {
+		return nil, err
+	}
+
+	for _, name := range t.names {
+		t.servers[name].config.Store(configs[name])
+		t.servers[name].jamf.SetAuth(auths[name])
+		t.servers[name].jamf.SetPolicyLookup(configs[name].swupdPolicy.needsComputerDetails())
+		t.servers[name].Notifier.SetTargets(configs[name].webhooks)
+	}
+
+	logger.SetLevel(envs[t.names[0]][EnvLogLevel])
+
+	return t.restartRequired(envs), nil
+}
+
+// restartRequired returns the environment variable names of the settings in restartSettings whose values in the
+// given Environments differ from when the service started
+func (t *Tenants) restartRequired(envs map[string]Environment) (changed []string) {
+	for _, name := range t.names {
+		namespace := envNamespace
+		if name != "" {
+			namespace = tenantNamespace(name)
+		}
+
+		for _, key := range restartSettings {
+			if envs[name][key] != t.started[name][key] {
+				changed = append(changed, namespace+key)
+			}
+		}
+	}
+
+	return changed
+}
+
+// WatchConfig is a goroutine that reloads the configuration when the service receives SIGHUP,
+// or when the config file or a secret file is modified. Failed reloads are logged and the current configuration is kept
+func (t *Tenants) WatchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	poll := time.NewTicker(configPollInterval)
+	defer poll.Stop()
+
+	modified := t.modTimes()
+	for {
+		select {
+		case <-hup:
+			logger.Info("received SIGHUP, reloading configuration")
+		case <-poll.C:
+			if !t.modified(modified) {
+				continue
+			}
+			logger.Info("configuration file modified, reloading configuration")
+		}
+
+		restart, err := t.Reload()
+		modified = t.modTimes()
+		if err != nil {
+			logger.Error("configuration reload failed, keeping current configuration: ", err)
+			continue
+		}
+
+		if len(restart) > 0 {
+			logger.Warnf("configuration reloaded, but these settings are only read at startup and have not been applied, "+
+				"restart the service to apply them: %s", strings.Join(restart, ", "))
+			continue
+		}
+
+		logger.Info("configuration reloaded")
+	}
+}
+
+// modTimes returns the modification time of the config file and each secret file, which is zero for missing files
+func (t *Tenants) modTimes() map[string]time.Time {
+	var paths []string
+	if t.configFile != "" {
+		paths = append(paths, t.configFile)
+	}
+	for _, name := range t.names {
+		paths = append(paths, t.servers[name].env().secretFiles()...)
+	}
+
+	times := make(map[string]time.Time)
+	for _, path := range paths {
+		var mt time.Time
+		if fi, err := os.Stat(path); err == nil {
+			mt = fi.ModTime()
+		}
+		times[path] = mt
+	}
+
+	return times
+}
+
+// modified returns true if a file has been modified since the given modification times were taken
+func (t *Tenants) modified(times map[string]time.Time) bool {
+	for path, mt := range times {
+		var now time.Time
+		if fi, err := os.Stat(path); err == nil {
+			now = fi.ModTime()
+		}
+		if !now.Equal(mt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tenantNamespace returns the environment variable prefix for the named tenant
+func tenantNamespace(name string) string {
+	return tenantEnvNamespace + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// checkTokensUnique returns an error if a client token value is accepted by more than one tenant,
+// as the tenant of requests without a tenant path prefix is found by token
+func (t *Tenants) checkTokensUnique(configs map[string]*serverConfig) error {
+	owners := make(map[tokenSecret]string)
+	for _, name := range t.names {
+		for _, ct := range configs[name].tokens.tokens {
+			for _, g := range ct.generations {
+				if owner, ok := owners[g.secret]; ok && owner != name {
+					return fmt.Errorf("client token %s of tenant %s is also a client token of tenant %s", ct.Name, name, owner)
+				}
+				owners[g.secret] = name
+			}
+		}
+	}
+
+	return nil
+}
+
+// Multi returns true if more than one tenant can be configured, i.e. EnvTenants is set
+func (t *Tenants) Multi() bool {
+	return len(t.names) > 1 || t.names[0] != ""
+}
+
+// Servers returns the Server for each tenant, in the order configured
+func (t *Tenants) Servers() []Server {
+	servers := make([]Server, 0, len(t.names))
+	for _, name := range t.names {
+		servers = append(servers, t.servers[name])
+	}
+
+	return servers
+}
+
+// DispatchByToken returns a handler which routes requests to the handler for the tenant whose client token
+// the request carries. handlers is keyed by tenant name, and each handler must authenticate the request itself
+func (t *Tenants) DispatchByToken(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rId := getRequestId(r)
+
+		bt, err := bearerToken(r)
+		if err != nil {
+			logger.WithRequest(rId, r).Error(err)
+			writeErrorResponse(w, err)
+			return
+		}
+
+		// every tenant is checked so the time taken does not reveal which tenant the token belongs to
+		tenant, found := "", false
+		for _, name := range t.names {
+			if t.servers[name].cfg().tokens.has(bt) {
+				tenant, found = name, true
+			}
+		}
+
+		if !found {
+			logger.WithRequest(rId, r).Error(errors.InvalidToken)
+			writeErrorResponse(w, errors.InvalidToken)
+			return
+		}
+
+		handlers[tenant].ServeHTTP(w, r)
+	})
+}
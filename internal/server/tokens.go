@@ -0,0 +1,417 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/logger"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTokenName is the name of the unrestricted token configured with EnvServerBearerToken
+	defaultTokenName = "default"
+	// allCommands allows a client token to send every command
+	allCommands = "*"
+	// tokenHashPrefix marks a token value given as the hex encoded SHA-256 digest of the token
+	tokenHashPrefix = "sha256:"
+	// generationCurrent is the generation of a token's current value, previous values are "previous-1" onwards
+	generationCurrent = "current"
+)
+
+const ctxKeyClientToken ctxKey = "clientToken"
+
+// tokenSecret is a token value held as its SHA-256 digest, so plaintext and hashed values are compared in the same way
+type tokenSecret [sha256.Size]byte
+
+// parseTokenSecret returns the tokenSecret for a token value, which is either plaintext or a hex encoded
+// SHA-256 digest prefixed with "sha256:"
+func parseTokenSecret(v string) (ts tokenSecret, err error) {
+	if !strings.HasPrefix(v, tokenHashPrefix) {
+		return sha256.Sum256([]byte(v)), nil
+	}
+
+	b, err := hex.DecodeString(strings.TrimPrefix(v, tokenHashPrefix))
+	if err != nil || len(b) != sha256.Size {
+		return ts, fmt.Errorf("token hash is not a hex encoded SHA-256 digest")
+	}
+
+	copy(ts[:], b)
+	return ts, nil
+}
+
+// matches returns true if the presented token has the digest of the tokenSecret, in constant time
+func (ts tokenSecret) matches(presented []byte) bool {
+	d := sha256.Sum256(presented)
+	return subtle.ConstantTimeCompare(d[:], ts[:]) == 1
+}
+
+// PreviousToken is a previous value of a ClientToken, accepted until it expires while clients move to the current value
+type PreviousToken struct {
+	Token   string    `json:"token" yaml:"token"`
+	Expires time.Time `json:"expires" yaml:"expires"`
+}
+
+// tokenGeneration is one accepted value of a ClientToken
+type tokenGeneration struct {
+	name    string
+	secret  tokenSecret
+	expires *time.Time
+}
+
+// ClientToken is a bearer token used by clients of the API.
+// Commands holds the command aliases the token may send, or "*" for all commands. Requesting codes and polling jobs
+// is allowed for every token. Expires and CIDRs are optional and restrict when and where the token may be used.
+// Token and Previous values may be given as plaintext or as "sha256:<hex digest>"
+type ClientToken struct {
+	Name     string          `json:"name" yaml:"name"`
+	Token    string          `json:"token" yaml:"token"`
+	Previous []PreviousToken `json:"previous,omitempty" yaml:"previous"`
+	Commands []string        `json:"commands" yaml:"commands"`
+	Expires  *time.Time      `json:"expires,omitempty" yaml:"expires"`
+	CIDRs    []string        `json:"cidrs,omitempty" yaml:"cidrs"`
+
+	generations []tokenGeneration
+	commands    map[string]bool
+	nets        []*net.IPNet
+}
+
+// allows returns true if the token may send the named command
+func (t *ClientToken) allows(name string) bool {
+	return t.commands[allCommands] || t.commands[name]
+}
+
+// allowsSource returns true if the token may be used from the given IP address
+func (t *ClientToken) allowsSource(ip string) bool {
+	if len(t.nets) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, n := range t.nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// init validates the token and resolves its commands and CIDRs
+func (t *ClientToken) init() error {
+	if t.Name == "" {
+		return fmt.Errorf("client token has no name")
+	}
+
+	if t.Token == "" {
+		return fmt.Errorf("client token %s has no token value", t.Name)
+	}
+
+	if len(t.Commands) == 0 {
+		return fmt.Errorf("client token %s has no commands", t.Name)
+	}
+
+	secret, err := parseTokenSecret(t.Token)
+	if err != nil {
+		return fmt.Errorf("client token %s: %w", t.Name, err)
+	}
+	t.generations = []tokenGeneration{{name: generationCurrent, secret: secret}}
+
+	for i, p := range t.Previous {
+		if p.Token == "" || p.Expires.IsZero() {
+			return fmt.Errorf("client token %s previous token %d must have a token value and an expiry", t.Name, i+1)
+		}
+
+		secret, err = parseTokenSecret(p.Token)
+		if err != nil {
+			return fmt.Errorf("client token %s previous token %d: %w", t.Name, i+1, err)
+		}
+
+		expires := p.Expires
+		t.generations = append(t.generations, tokenGeneration{
+			name:    fmt.Sprintf("previous-%d", i+1),
+			secret:  secret,
+			expires: &expires,
+		})
+	}
+
+	t.commands = make(map[string]bool)
+	for _, c := range t.Commands {
+		if c == allCommands {
+			t.commands[allCommands] = true
+			continue
+		}
+
+		name, ok := commandAliases[c]
+		if !ok {
+			return fmt.Errorf("client token %s has unknown command: %s", t.Name, c)
+		}
+		t.commands[name] = true
+	}
+
+	for _, c := range t.CIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("client token %s has invalid CIDR: %s", t.Name, c)
+		}
+		t.nets = append(t.nets, n)
+	}
+
+	return nil
+}
+
+// TokenRegistry holds the client tokens accepted by MiddlewareBearerAuth
+type TokenRegistry struct {
+	tokens            []*ClientToken
+	trustProxyHeaders bool
+}
+
+// NewTokenRegistry builds a TokenRegistry from the given Environment.
+// Tokens are read from the JSON file at EnvClientTokensFile and from EnvClientTokens, which holds the client tokens
+// given in the config file as JSON. EnvServerBearerToken, when set, is added as an unrestricted token named "default",
+// with any previous values from EnvServerBearerTokenPrevious.
+// At least one token must be configured
+func NewTokenRegistry(env Environment) (*TokenRegistry, error) {
+	reg := &TokenRegistry{}
+
+	var err error
+	if reg.trustProxyHeaders, err = env.Bool(EnvTrustProxyHeaders, false); err != nil {
+		return nil, err
+	}
+
+	if path := env[EnvClientTokensFile]; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client tokens file: %w", err)
+		}
+
+		if err = json.Unmarshal(data, &reg.tokens); err != nil {
+			return nil, fmt.Errorf("could not parse client tokens file: %w", err)
+		}
+	}
+
+	if v := env[EnvClientTokens]; v != "" {
+		var tokens []*ClientToken
+		if err = json.Unmarshal([]byte(v), &tokens); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", EnvClientTokens, err)
+		}
+		reg.tokens = append(reg.tokens, tokens...)
+	}
+
+	if t := env[EnvServerBearerToken]; t != "" {
+		previous, err := parsePreviousTokens(env[EnvServerBearerTokenPrevious])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", EnvServerBearerTokenPrevious, err)
+		}
+
+		reg.tokens = append(reg.tokens, &ClientToken{
+			Name:     defaultTokenName,
+			Token:    t,
+			Previous: previous,
+			Commands: []string{allCommands},
+		})
+	}
+
+	if len(reg.tokens) == 0 {
+		return nil, fmt.Errorf("no client tokens configured, set %s, %s or client_tokens in the config file",
+			EnvServerBearerToken, EnvClientTokensFile)
+	}
+
+	// a value accepted by two tokens would be authenticated as whichever is configured last, so values must be unique
+	// across every generation of every token
+	names := make(map[string]bool)
+	owners := make(map[tokenSecret]string)
+	for _, t := range reg.tokens {
+		if err = t.init(); err != nil {
+			return nil, err
+		}
+
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate client token name: %s", t.Name)
+		}
+		names[t.Name] = true
+
+		for _, g := range t.generations {
+			if owner, ok := owners[g.secret]; ok {
+				return nil, fmt.Errorf("client token %s has the same value as client token %s", t.Name, owner)
+			}
+			owners[g.secret] = t.Name
+		}
+	}
+
+	return reg, nil
+}
+
+// parsePreviousTokens parses a comma separated list of previous token values, each followed by "@" and its expiry
+// as an RFC 3339 timestamp, e.g. "sha256:9f86...@2024-07-01T00:00:00Z"
+func parsePreviousTokens(v string) (previous []PreviousToken, err error) {
+	for _, entry := range splitList(v) {
+		i := strings.LastIndex(entry, "@")
+		if i < 0 {
+			return nil, fmt.Errorf("previous token has no expiry")
+		}
+
+		expires, err := time.Parse(time.RFC3339, entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("previous token expiry is not an RFC 3339 timestamp: %s", entry[i+1:])
+		}
+
+		previous = append(previous, PreviousToken{Token: entry[:i], Expires: expires})
+	}
+
+	return previous, nil
+}
+
+// has returns true if the given token value is any generation of any token in the registry, expired or not
+func (reg *TokenRegistry) has(bt []byte) bool {
+	found := false
+	for _, t := range reg.tokens {
+		for _, g := range t.generations {
+			if g.secret.matches(bt) {
+				found = true
+			}
+		}
+	}
+
+	return found
+}
+
+// byName returns the client token with the given name, or nil if there is none
+func (reg *TokenRegistry) byName(name string) *ClientToken {
+	for _, t := range reg.tokens {
+		if t.Name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// hasSecret returns true if any generation of any client token has the given secret
+func (reg *TokenRegistry) hasSecret(secret tokenSecret) bool {
+	for _, t := range reg.tokens {
+		for _, g := range t.generations {
+			if g.secret == secret {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// authenticate returns the client token carried by the request and the generation of the token value used,
+// if it is known, unexpired and used from an allowed source address
+func (reg *TokenRegistry) authenticate(r *http.Request) (*ClientToken, string, error) {
+	bt, err := bearerToken(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// every generation of every token is compared so the time taken does not reveal which token matched
+	var match *ClientToken
+	var gen tokenGeneration
+	for _, t := range reg.tokens {
+		for _, g := range t.generations {
+			if g.secret.matches(bt) {
+				match, gen = t, g
+			}
+		}
+	}
+
+	if match == nil {
+		return nil, "", errors.InvalidToken
+	}
+
+	now := time.Now()
+	if match.Expires != nil && now.After(*match.Expires) {
+		return match, gen.name, errors.TokenExpired
+	}
+
+	if gen.expires != nil && now.After(*gen.expires) {
+		return match, gen.name, errors.TokenExpired
+	}
+
+	if ip := clientIP(r, reg.trustProxyHeaders); !match.allowsSource(ip) {
+		logger.WithFields(map[string]interface{}{
+			"event":    "token_source_denied",
+			"security": true,
+			"token":    match.Name,
+			"ip":       ip,
+		}).Warn("client token used from an address outside its allowed CIDRs")
+		return match, gen.name, errors.TokenSourceDenied
+	}
+
+	return match, gen.name, nil
+}
+
+// withClientToken returns a copy of the request with the given client token attached to its context
+func withClientToken(r *http.Request, t *ClientToken) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyClientToken, t))
+}
+
+// getClientToken returns the client token attached to the request by MiddlewareBearerAuth
+func getClientToken(r *http.Request) *ClientToken {
+	if t, ok := r.Context().Value(ctxKeyClientToken).(*ClientToken); ok {
+		return t
+	}
+
+	return nil
+}
+
+// checkScope returns errors.CommandNotEnabled if the named command is not enabled for the Server's tenant,
+// or errors.TokenScopeDenied if the request's client token may not send it
+func (s Server) checkScope(r *http.Request, name string) error {
+	return s.checkTokenScope(getClientToken(r), name)
+}
+
+// checkCodeScope checks a command registered with a code, which is sent later by the Jamf webhook, against the
+// current configuration: the command must still be enabled, and the client token which requested the code must still
+// exist, be unexpired and allow the command
+func (s Server) checkCodeScope(code *Code) error {
+	t := s.cfg().tokens.byName(code.token)
+	if t != nil && t.Expires != nil && time.Now().After(*t.Expires) {
+		return errors.TokenExpired
+	}
+
+	return s.checkTokenScope(t, code.command)
+}
+
+// checkTokenScope returns errors.CommandNotEnabled if the named command is not enabled for the Server's tenant,
+// or errors.TokenScopeDenied if the given client token, which may be nil, may not send it
+func (s Server) checkTokenScope(t *ClientToken, name string) error {
+	if !s.cfg().enabled(name) {
+		logger.Debugf("%s command not enabled for tenant '%s'", name, s.tenant)
+		return errors.CommandNotEnabled
+	}
+
+	if t == nil || !t.allows(name) {
+		tokenName := ""
+		if t != nil {
+			tokenName = t.Name
+		}
+
+		logger.WithFields(map[string]interface{}{
+			"event":    "token_scope_denied",
+			"security": true,
+			"tenant":   s.tenant,
+			"token":    tokenName,
+			"command":  name,
+		}).Warn("client token not allowed to send command")
+		return errors.TokenScopeDenied
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	e "errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTokenSecret(t *testing.T) {
+	digest := sha256.Sum256([]byte("s3cret"))
+
+	plain, err := parseTokenSecret("s3cret")
+	if err != nil || plain != tokenSecret(digest) {
+		t.Errorf("plaintext token: got %x (%v), want %x", plain, err, digest)
+	}
+
+	hashed, err := parseTokenSecret(tokenHashPrefix + hex.EncodeToString(digest[:]))
+	if err != nil || hashed != plain {
+		t.Errorf("hashed token: got %x (%v), want %x", hashed, err, digest)
+	}
+
+	if !hashed.matches([]byte("s3cret")) || hashed.matches([]byte("s3cret ")) {
+		t.Error("hashed token does not match only its plaintext value")
+	}
+
+	for _, v := range []string{
+		tokenHashPrefix + "not-hex",
+		tokenHashPrefix + hex.EncodeToString(digest[:16]),
+		tokenHashPrefix,
+	} {
+		if _, err = parseTokenSecret(v); err == nil {
+			t.Errorf("expected an error for %q", v)
+		}
+	}
+}
+
+// testTokenRegistry returns a TokenRegistry with the given client tokens
+func testTokenRegistry(t *testing.T, tokens ...*ClientToken) *TokenRegistry {
+	t.Helper()
+
+	b, err := json.Marshal(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := NewTokenRegistry(Environment{EnvClientTokens: string(b)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reg
+}
+
+func TestTokenRegistryAuthenticate(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	digest := sha256.Sum256([]byte("hashed-token"))
+
+	reg := testTokenRegistry(t,
+		&ClientToken{
+			Name:     "rotating",
+			Token:    "current-token",
+			Commands: []string{"erase"},
+			Previous: []PreviousToken{
+				{Token: "previous-token", Expires: future},
+				{Token: "expired-previous-token", Expires: past},
+			},
+		},
+		&ClientToken{Name: "hashed", Token: tokenHashPrefix + hex.EncodeToString(digest[:]), Commands: []string{"*"}},
+		&ClientToken{Name: "expired", Token: "expired-token", Commands: []string{"*"}, Expires: &past},
+		&ClientToken{Name: "office", Token: "office-token", Commands: []string{"*"}, CIDRs: []string{"192.0.2.0/24"}},
+	)
+
+	tests := []struct {
+		header  string
+		remote  string
+		name    string
+		gen     string
+		wantErr error
+	}{
+		{header: "Bearer current-token", name: "rotating", gen: generationCurrent},
+		{header: "Bearer previous-token", name: "rotating", gen: "previous-1"},
+		{header: "Bearer expired-previous-token", name: "rotating", gen: "previous-2", wantErr: errors.TokenExpired},
+		{header: "Bearer hashed-token", name: "hashed", gen: generationCurrent},
+		{header: "Bearer expired-token", name: "expired", gen: generationCurrent, wantErr: errors.TokenExpired},
+		{header: "Bearer office-token", remote: "192.0.2.10:1234", name: "office", gen: generationCurrent},
+		{header: "Bearer office-token", remote: "198.51.100.1:1234", name: "office", gen: generationCurrent,
+			wantErr: errors.TokenSourceDenied},
+		{header: "Bearer unknown-token", wantErr: errors.InvalidToken},
+		{header: "Bearer " + tokenHashPrefix + hex.EncodeToString(digest[:]), wantErr: errors.InvalidToken},
+		{header: "current-token", wantErr: errors.BadToken},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/code/"+testUdid, nil)
+		r.Header.Set("Authorization", tt.header)
+		if tt.remote != "" {
+			r.RemoteAddr = tt.remote
+		}
+
+		tok, gen, err := reg.authenticate(r)
+		if !e.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+			t.Errorf("%s: expected error %v, got %v", tt.header, tt.wantErr, err)
+			continue
+		}
+
+		name := ""
+		if tok != nil {
+			name = tok.Name
+		}
+		if name != tt.name || gen != tt.gen {
+			t.Errorf("%s: authenticated as %s (%s), want %s (%s)", tt.header, name, gen, tt.name, tt.gen)
+		}
+	}
+}
+
+func TestClientTokenAllows(t *testing.T) {
+	reg := testTokenRegistry(t,
+		&ClientToken{Name: "erase-only", Token: "a", Commands: []string{"erase"}},
+		&ClientToken{Name: "all", Token: "b", Commands: []string{"*"}},
+	)
+
+	if erase := reg.tokens[0]; !erase.allows(CommandEraseDevice) || erase.allows(CommandDeviceLock) {
+		t.Error("erase-only token scope not enforced")
+	}
+
+	if all := reg.tokens[1]; !all.allows(CommandDeviceLock) || !all.allows(CommandShutDownDevice) {
+		t.Error("unrestricted token does not allow every command")
+	}
+}
+
+func TestNewTokenRegistryInvalid(t *testing.T) {
+	for name, tokens := range map[string][]*ClientToken{
+		"no name":         {{Token: "a", Commands: []string{"*"}}},
+		"no commands":     {{Name: "a", Token: "a"}},
+		"unknown command": {{Name: "a", Token: "a", Commands: []string{"wipe"}}},
+		"invalid CIDR":    {{Name: "a", Token: "a", Commands: []string{"*"}, CIDRs: []string{"10.0.0.0"}}},
+		"duplicate name":  {{Name: "a", Token: "a", Commands: []string{"*"}}, {Name: "a", Token: "b", Commands: []string{"*"}}},
+		"duplicate value": {{Name: "a", Token: "x", Commands: []string{"erase"}}, {Name: "b", Token: "x", Commands: []string{"*"}}},
+		"duplicate hashed value": {{Name: "a", Token: "x", Commands: []string{"erase"}},
+			{Name: "b", Token: tokenHashPrefix + "2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881", Commands: []string{"*"}}},
+		"duplicate previous value": {{Name: "a", Token: "x", Commands: []string{"erase"}},
+			{Name: "b", Token: "y", Commands: []string{"*"}, Previous: []PreviousToken{{Token: "x", Expires: time.Now().Add(time.Hour)}}}},
+		"previous same as current": {{Name: "a", Token: "x", Commands: []string{"*"},
+			Previous: []PreviousToken{{Token: "x", Expires: time.Now().Add(time.Hour)}}}},
+		"previous expiry": {{Name: "a", Token: "a", Commands: []string{"*"}, Previous: []PreviousToken{{Token: "b"}}}},
+		"invalid sha256":  {{Name: "a", Token: tokenHashPrefix + "abc", Commands: []string{"*"}}},
+	} {
+		b, _ := json.Marshal(tokens)
+		if _, err := NewTokenRegistry(Environment{EnvClientTokens: string(b)}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if _, err := NewTokenRegistry(Environment{}); err == nil {
+		t.Error("expected an error without client tokens")
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"command-on-demand/internal/jamf"
+	"command-on-demand/internal/logger"
+	"time"
+)
+
+// clockSkew allows for differences between the service and Jamf clocks when matching sent commands
+const clockSkew = 2 * time.Minute
+
+// TrackingConfig holds the configuration for tracking the delivery of sent commands
+type TrackingConfig struct {
+	interval    time.Duration
+	pendingWarn time.Duration
+	timeout     time.Duration
+}
+
+// NewTrackingConfig builds a TrackingConfig from the given Environment
+func NewTrackingConfig(env Environment) (c TrackingConfig, err error) {
+	if c.interval, err = env.Duration(EnvCommandTrackInterval, time.Minute); err != nil {
+		return
+	}
+
+	if c.pendingWarn, err = env.Duration(EnvCommandPendingWarn, time.Hour); err != nil {
+		return
+	}
+
+	c.timeout, err = env.Duration(EnvCommandTrackTimeout, 7*24*time.Hour)
+
+	return
+}
+
+// TrackCommands is a goroutine that runs every configured interval and updates the jobs for sent commands with
+// the state of the command in the device's MDM command history, until it is acknowledged, errors or tracking times out
+func (s Server) TrackCommands() {
+	for range time.Tick(s.tracking.interval) {
+		for _, job := range s.JobStore.tracked() {
+			s.trackJob(job)
+		}
+	}
+}
+
+// trackJob updates the given job with the state of its command in Jamf
+func (s Server) trackJob(job Job) {
+	pending := time.Since(*job.Sent)
+
+	if pending > s.tracking.timeout {
+		logger.Warnf("stopped tracking %s command to %s (job %s) after %s, last MDM state: '%s'",
+			job.Command, job.Udid, job.Id, s.tracking.timeout, job.MdmState)
+		s.JobStore.updateJob(job.Id, func(j *Job) {
+			j.tracking = false
+		})
+		return
+	}
+
+	managementId := job.managementId
+	if managementId == "" {
+		comp := jamf.Computer{}
+		comp.Id = job.computerId
+		if err := s.jamf.ResolveManagementId(&comp); err != nil {
+			logger.Errorf("could not resolve management ID to track job %s: %s", job.Id, err)
+			return
+		}
+		managementId = comp.ManagementId
+	}
+
+	cmds, err := s.jamf.GetMdmCommands(managementId)
+	if err != nil {
+		logger.Errorf("could not get MDM command history to track job %s: %s", job.Id, err)
+		return
+	}
+
+	mdmState := jamf.MdmCommandStatePending
+	if cmd, ok := matchMdmCommand(cmds, job); ok {
+		mdmState = cmd.CommandState
+	}
+
+	warn := mdmState == jamf.MdmCommandStatePending && pending > s.tracking.pendingWarn && !job.warned
+	if warn {
+		logger.Warnf("%s command to %s (job %s) has been pending for %s", job.Command, job.Udid, job.Id,
+			pending.Round(time.Second))
+	}
+
+	if mdmState == job.MdmState && !warn && job.managementId != "" {
+		return
+	}
+
+	s.JobStore.updateJob(job.Id, func(j *Job) {
+		j.managementId = managementId
+		j.MdmState = mdmState
+		j.warned = j.warned || warn
+
+		switch mdmState {
+		case jamf.MdmCommandStateAcknowledged:
+			j.State = JobStateAcknowledged
+			j.tracking = false
+		case jamf.MdmCommandStateError:
+			j.State = JobStateFailed
+			j.Error = "device reported an error for the command"
+			j.tracking = false
+		case jamf.MdmCommandStateNotNow:
+			j.State = JobStateNotNow
+		}
+	})
+
+	if mdmState != job.MdmState {
+		switch mdmState {
+		case jamf.MdmCommandStateError:
+			logger.Errorf("%s command to %s (job %s) failed on device", job.Command, job.Udid, job.Id)
+		default:
+			logger.Infof("%s command to %s (job %s) MDM state is now %s", job.Command, job.Udid, job.Id, mdmState)
+		}
+	}
+}
+
+// matchMdmCommand returns the earliest command in the history with the job's command type which was sent after the job
+func matchMdmCommand(cmds []jamf.MdmCommand, job Job) (match jamf.MdmCommand, ok bool) {
+	after := job.Sent.Add(-clockSkew)
+
+	for _, cmd := range cmds {
+		if cmd.CommandType != job.mdmCommandType || cmd.Sent().Before(after) {
+			continue
+		}
+
+		if !ok || cmd.Sent().Before(match.Sent()) {
+			match, ok = cmd, true
+		}
+	}
+
+	return
+}
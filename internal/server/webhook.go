@@ -0,0 +1,179 @@
+package server
+
+import (
+	"command-on-demand/internal/errors"
+	"command-on-demand/internal/jamf"
+	"command-on-demand/internal/logger"
+	"crypto/subtle"
+	"encoding/json"
+	e "errors"
+	"net/http"
+)
+
+const webhookEventInventoryCompleted = "ComputerInventoryCompleted"
+
+// jamfWebhook is the subset of a Jamf webhook payload used by JamfWebhookHandler
+type jamfWebhook struct {
+	Webhook struct {
+		Id           int    `json:"id"`
+		Name         string `json:"name"`
+		WebhookEvent string `json:"webhookEvent"`
+	} `json:"webhook"`
+	Event struct {
+		Computer struct {
+			Udid         string `json:"udid"`
+			JssId        int    `json:"jssID"`
+			SerialNumber string `json:"serialNumber"`
+		} `json:"computer"`
+	} `json:"event"`
+}
+
+// JamfWebhookHandler receives Jamf ComputerInventoryCompleted webhooks.
+// When the computer has an outstanding code with a registered command, the code proof is checked and the command is
+// sent without a further client request. The webhook is acknowledged straight away and processed in the background.
+func (s Server) JamfWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var hook jamfWebhook
+
+	// webhook payloads contain many more fields than are used here, so decodeBody's strictness is not wanted
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&hook); err != nil {
+		logger.Debugf("could not decode Jamf webhook: %s", err)
+		writeErrorResponse(w, errors.BodyInvalid)
+		return
+	}
+
+	if hook.Webhook.WebhookEvent != webhookEventInventoryCompleted {
+		logger.Debugf("ignoring Jamf webhook event: %s", hook.Webhook.WebhookEvent)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	go s.completeCodeProof(getRequestId(r), hook.Event.Computer.Udid)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// completeCodeProof sends the command registered with the outstanding code for the given UDID, if the code proof
+// extension attribute matches. The command is checked as a client request would be: the command must still be enabled
+// and allowed by the client token which requested the code, the UDID must not be locked out, and a mismatch counts as
+// a failed code proof towards its lockout. Unlike checkCode, a mismatch does not consume the code, as the inventory may
+// have been submitted before the client wrote the code
+func (s Server) completeCodeProof(rId string, udid string) {
+	code, err := s.CodeStore.getCode(udid)
+	if err != nil || code.command == "" {
+		return
+	}
+
+	build, ok := s.defaultBuilder(code.command)
+	if !ok {
+		logger.Errorf("no builder for registered command %s", code.command)
+		return
+	}
+
+	rec := auditRecord{requestId: rId, token: code.token, source: webhookSource, command: code.command, udid: udid}
+
+	// a code whose token or command has since been revoked can never be completed, so it is removed
+	if err = s.checkCodeScope(code); err != nil {
+		logger.Errorf("%s command registered for %s is no longer allowed: %s", code.command, udid, err)
+		s.auditValidation(rec, jamf.Computer{}, err)
+		s.CodeStore.consumeCodeValue(udid, code.value)
+		return
+	}
+
+	keys := []string{udidLockoutKey(udid)}
+	if err = s.Lockout.check(keys); err != nil {
+		logger.Error("webhook code proof rejected: ", err)
+		s.auditValidation(rec, jamf.Computer{}, err)
+		return
+	}
+
+	comp, err := s.jamf.GetComputer(udid)
+	if err != nil {
+		logger.Error("could not get computer from Jamf: ", err)
+		return
+	}
+
+	// the code is kept, so a later inventory update with the matching value can still complete it
+	if err = s.matchCode(comp, code); err != nil {
+		logger.Debugf("webhook code proof for %s not yet complete: %s", udid, err)
+		if e.Is(err, errors.CodeMismatch) || e.Is(err, errors.ExtAttrNotFound) {
+			s.Lockout.recordFailure(keys, err)
+		}
+		s.auditValidation(rec, comp, err)
+		s.notifyCodeMismatch(rec, comp, err)
+		return
+	}
+
+	// the code is consumed before the command is sent, so a repeated webhook, a client request or another replica
+	// completing the same code cannot send the command again. A code issued since this one was read is kept
+	if _, err = s.CodeStore.consumeCodeValue(udid, code.value); err != nil {
+		logger.Debugf("code for %s was consumed or replaced before the webhook could complete it", udid)
+		return
+	}
+
+	job := s.JobStore.NewJob(code.command, udid, code.token)
+	logger.Infof("code proof completed by Jamf webhook for %s, sending %s command (job %s)", udid, code.command, job.Id)
+
+	if err = s.auditValidation(rec, comp, nil); err != nil {
+		s.JobStore.setState(job.Id, JobStateFailed, err)
+		return
+	}
+
+	cmd, err := s.buildAndSend(comp, code.command, build)
+	s.auditCommand(rec, comp, cmd, err)
+	s.notifyCommand(rec, job.Id, comp, cmd, err)
+	if err != nil {
+		logger.Errorf("failed to send %s command registered for %s: %s", code.command, udid, err)
+		s.JobStore.setState(job.Id, JobStateFailed, err)
+		return
+	}
+
+	s.JobStore.setSent(job.Id, comp, cmd.CommandType())
+}
+
+// MiddlewareWebhookAuth authenticates inbound Jamf webhooks with either a shared secret, sent by Jamf using header
+// authentication as a bearer token, or basic auth. Webhooks are obfuscated in the same way as unknown paths when
+// neither is configured
+func (s Server) MiddlewareWebhookAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rId := getRequestId(r)
+
+		env := s.env()
+		secret := env[EnvJamfWebhookSecret]
+		user, pass := env[EnvJamfWebhookUser], env[EnvJamfWebhookPassword]
+
+		var err error
+		switch {
+		case secret != "":
+			err = checkBearer(r, secret)
+		case user != "" && pass != "":
+			err = checkBasic(r, user, pass)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err != nil {
+			logger.WithRequest(rId, r).Error("webhook ", err)
+			writeErrorResponse(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkBasic returns an error if the request does not carry the given basic auth credentials
+func checkBasic(r *http.Request, user string, pass string) error {
+	u, p, ok := r.BasicAuth()
+	if !ok {
+		return errors.BadToken
+	}
+
+	um := subtle.ConstantTimeCompare([]byte(u), []byte(user))
+	pm := subtle.ConstantTimeCompare([]byte(p), []byte(pass))
+	if um&pm != 1 {
+		return errors.InvalidToken
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bufio"
+	"command-on-demand/internal/audit"
+	"command-on-demand/internal/jamf"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testCodeProofEA = "cmdod-code"
+
+// fakeJamf is a Jamf API serving a single computer, whose code proof extension attribute can be set,
+// and counting the MDM commands sent to it
+type fakeJamf struct {
+	sync.Mutex
+	codeProof string
+	commands  atomic.Int32
+}
+
+func (f *fakeJamf) setCodeProof(v string) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.codeProof = v
+}
+
+func (f *fakeJamf) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/api/v1/auth/token":
+		json.NewEncoder(w).Encode(jamf.Token{Value: "jamf-token", Expires: time.Now().Add(time.Hour).Format(time.RFC3339)})
+	case r.URL.Path == "/api/v1/computers-inventory" && r.URL.Query().Get("filter") == `udid=="`+testUdid+`"`:
+		f.Lock()
+		codeProof, _ := json.Marshal(f.codeProof)
+		f.Unlock()
+		fmt.Fprintf(w, `{"totalCount":1,"results":[{"id":"1","udid":"%s","general":{"managementId":"mgmt-1"},`+
+			`"hardware":{"serialNumber":"C02TEST"},"extensionAttributes":[{"name":"%s","values":[%s]}]}]}`,
+			testUdid, testCodeProofEA, codeProof)
+	case r.URL.Path == "/api/v2/mdm/commands" && r.Method == http.MethodPost:
+		f.commands.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newTestJamfClient returns a jamf.Client for the given fake Jamf API
+func newTestJamfClient(t *testing.T, h http.Handler) *jamf.Client {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(h)
+	t.Cleanup(srv.Close)
+
+	opts := jamf.DefaultClientOptions()
+	opts.Transport = srv.Client().Transport
+
+	c, err := jamf.NewClient(strings.TrimPrefix(srv.URL, "https://"), jamf.BasicAuth{Username: "u", Password: "p"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// testWebhookEnv is the Environment of the Server returned by newTestWebhookServer
+func testWebhookEnv() Environment {
+	return Environment{
+		EnvCodeProofExtAttName: testCodeProofEA,
+		EnvCommands:            "restart",
+		EnvClientTokens:        `[{"name":"helpdesk","token":"helpdesk-token","commands":["restart"]}]`,
+	}
+}
+
+// newTestWebhookServer returns a Server for the fake Jamf API with lockout enabled, and the path of its audit log
+func newTestWebhookServer(t *testing.T, fj *fakeJamf) (Server, string) {
+	t.Helper()
+
+	cfg, err := newServerConfig(testWebhookEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := openAuditLog(Environment{EnvAuditLogPath: path, EnvAuditHMACKey: strings.Repeat("k", 32)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+
+	state := NewMemoryStateStore()
+	s := Server{
+		config:     &atomic.Pointer[serverConfig]{},
+		jamf:       newTestJamfClient(t, fj),
+		Lockout:    NewLockout(testLockoutConfig(), state, nil),
+		Guard:      NewCommandGuard(GuardConfig{}, state, nil),
+		CodeStore:  NewMemoryCodeStore(),
+		StateStore: state,
+		JobStore:   NewJobStore(),
+		auditLog:   auditLog,
+	}
+	s.config.Store(cfg)
+
+	return s, path
+}
+
+// readAuditEntries returns the entries of the audit log at the given path
+func readAuditEntries(t *testing.T, path string) (entries []audit.Entry) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e audit.Entry
+		if err = json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+func TestCompleteCodeProof(t *testing.T) {
+	fj := &fakeJamf{}
+	s, path := newTestWebhookServer(t, fj)
+
+	code, err := s.CodeStore.NewCode(testUdid, CommandRestartDevice, "helpdesk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fj.setCodeProof(code.value)
+
+	s.completeCodeProof("req-1", testUdid)
+	s.completeCodeProof("req-2", testUdid)
+
+	if n := fj.commands.Load(); n != 1 {
+		t.Fatalf("expected one command to be sent for a repeated webhook, got %d", n)
+	}
+
+	if _, err = s.CodeStore.getCode(testUdid); err == nil {
+		t.Error("expected the code to be consumed")
+	}
+
+	entries := readAuditEntries(t, path)
+	if len(entries) != 2 || entries[0].Outcome != audit.OutcomeAccepted || entries[1].Outcome != audit.OutcomeSent {
+		t.Fatalf("expected an accepted validation and a sent command, got %+v", entries)
+	}
+
+	if entries[1].Token != "helpdesk" || entries[1].Source != webhookSource {
+		t.Errorf("expected the command to be attributed to the requesting token, got %+v", entries[1])
+	}
+}
+
+func TestCompleteCodeProofMismatchLockout(t *testing.T) {
+	fj := &fakeJamf{}
+	s, path := newTestWebhookServer(t, fj)
+
+	code, err := s.CodeStore.NewCode(testUdid, CommandRestartDevice, "helpdesk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fj.setCodeProof("wrong")
+
+	for i := 0; i < testLockoutConfig().failureThreshold; i++ {
+		s.completeCodeProof("req", testUdid)
+	}
+
+	if _, err = s.CodeStore.getCode(testUdid); err != nil {
+		t.Errorf("expected the code to be kept after a mismatch, got %v", err)
+	}
+
+	// the matching code is refused once the UDID is locked out
+	fj.setCodeProof(code.value)
+	s.completeCodeProof("req", testUdid)
+
+	if n := fj.commands.Load(); n != 0 {
+		t.Fatalf("expected no command to be sent, got %d", n)
+	}
+
+	entries := readAuditEntries(t, path)
+	if len(entries) != testLockoutConfig().failureThreshold+1 {
+		t.Fatalf("expected a rejected validation for each webhook, got %+v", entries)
+	}
+
+	for _, e := range entries {
+		if e.Outcome != audit.OutcomeRejected || e.Token != "helpdesk" {
+			t.Errorf("expected a rejected validation for the requesting token, got %+v", e)
+		}
+	}
+
+	if last := entries[len(entries)-1]; !strings.Contains(last.Error, "too many attempts") {
+		t.Errorf("expected the last webhook to be rejected by the lockout, got %+v", last)
+	}
+}
+
+func TestCompleteCodeProofRevoked(t *testing.T) {
+	tests := []struct {
+		name string
+		env  Environment
+		want string
+	}{
+		{
+			name: "token removed",
+			env:  Environment{EnvClientTokens: `[{"name":"other","token":"other-token","commands":["*"]}]`},
+			want: "not allowed",
+		},
+		{
+			name: "token no longer allows command",
+			env:  Environment{EnvClientTokens: `[{"name":"helpdesk","token":"helpdesk-token","commands":["swupd"]}]`},
+			want: "not allowed",
+		},
+		{
+			name: "token expired",
+			env: Environment{EnvClientTokens: `[{"name":"helpdesk","token":"helpdesk-token","commands":["restart"],` +
+				`"expires":"2020-01-01T00:00:00Z"}]`},
+			want: "expired",
+		},
+		{
+			name: "command disabled",
+			env:  Environment{EnvCommands: "swupd"},
+			want: "not enabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fj := &fakeJamf{}
+			s, path := newTestWebhookServer(t, fj)
+
+			code, err := s.CodeStore.NewCode(testUdid, CommandRestartDevice, "helpdesk")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fj.setCodeProof(code.value)
+
+			cfg, err := newServerConfig(testWebhookEnv().overlay(tt.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.config.Store(cfg)
+
+			s.completeCodeProof("req", testUdid)
+
+			if n := fj.commands.Load(); n != 0 {
+				t.Fatalf("expected no command to be sent, got %d", n)
+			}
+
+			if _, err = s.CodeStore.getCode(testUdid); err == nil {
+				t.Error("expected the code to be removed")
+			}
+
+			entries := readAuditEntries(t, path)
+			if len(entries) != 1 || entries[0].Outcome != audit.OutcomeRejected || !strings.Contains(entries[0].Error, tt.want) {
+				t.Errorf("expected a rejected validation containing '%s', got %+v", tt.want, entries)
+			}
+		})
+	}
+}
@@ -3,8 +3,8 @@ package util
 import (
 	"crypto/rand"
 	"encoding/base64"
-	mathrand "math/rand"
-	"strconv"
+	"fmt"
+	"math/big"
 	"strings"
 )
 
@@ -24,11 +24,12 @@ func RandomBytes(nBytes int, encB64 bool) (s string, err error) {
 	return sb.String(), nil
 }
 
-func RandomSixDigitPin() string {
-	var pin [6]string
-	for i := 0; i < 6; i++ {
-		pin[i] = strconv.Itoa(mathrand.Intn(10))
+// RandomSixDigitPin returns a cryptographically random 6-digit PIN, which may have leading zeros
+func RandomSixDigitPin() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
 	}
 
-	return strings.Join(pin[:], "")
+	return fmt.Sprintf("%06d", n.Int64()), nil
 }